@@ -0,0 +1,117 @@
+package bee
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	kDefaultAuthTimeout     = 10 * time.Second
+	kDefaultAuthMaxMessages = 1
+)
+
+var (
+	ErrAuthTimeout = errors.New("authentication timeout")
+	ErrAuthFailed  = errors.New("authentication failed")
+)
+
+// --------------------------------------------------------------------------------
+type AuthResult struct {
+	Identifier string
+	Tag        string
+	Attributes map[string]interface{}
+}
+
+// AuthError 用于拒绝连接，Code 为关闭连接时使用的 close code，Code 小于等于 0 时使用 ClosePolicyViolation。
+type AuthError struct {
+	Code   int
+	Reason string
+}
+
+func (this *AuthError) Error() string {
+	return this.Reason
+}
+
+// Authenticator 在 Session 打开之前处理客户端发送的消息。
+// 返回 result 表示验证通过，Session 将使用 result 中的 identifier、tag 及属性，然后调用 Handler 的 DidOpenSession；
+// 返回 err 表示拒绝连接，err 为 *AuthError 时使用其 Code 关闭连接，否则使用 ClosePolicyViolation；
+// result 和 err 都为 nil 表示需要更多的消息才能完成验证。
+type Authenticator func(s Session, data []byte) (result *AuthResult, err error)
+
+// WithAuthenticator 设置认证器，Session 在认证通过之前不会调用 Handler 的任何方法，
+// 超过 timeout 或者收到 maxMessages 条消息之后仍未认证通过，将关闭连接。
+func WithAuthenticator(a Authenticator, timeout time.Duration, maxMessages int) Option {
+	return optionFunc(func(s *session) {
+		if a == nil {
+			s.auth = nil
+			return
+		}
+		if timeout <= 0 {
+			timeout = kDefaultAuthTimeout
+		}
+		if maxMessages <= 0 {
+			maxMessages = kDefaultAuthMaxMessages
+		}
+		s.auth = &authState{authenticator: a, timeout: timeout, maxMessages: maxMessages}
+	})
+}
+
+// --------------------------------------------------------------------------------
+type authState struct {
+	authenticator Authenticator
+	timeout       time.Duration
+	maxMessages   int
+	count         int
+	timer         *time.Timer
+}
+
+func (this *session) startAuth() {
+	this.auth.timer = time.AfterFunc(this.auth.timeout, func() {
+		this.mu.Lock()
+		var opened = this.isOpened
+		this.mu.Unlock()
+
+		if opened == false {
+			this.CloseWithCode(ClosePolicyViolation, ErrAuthTimeout.Error())
+		}
+	})
+}
+
+// authenticate 在 read goroutine 中调用，返回 err 表示认证失败，连接已被关闭。
+func (this *session) authenticate(data []byte) error {
+	var a = this.auth
+	a.count++
+
+	result, err := a.authenticator(this, data)
+	if err == nil && result == nil && a.count >= a.maxMessages {
+		err = ErrAuthFailed
+	}
+
+	if err != nil {
+		a.timer.Stop()
+		var code = ClosePolicyViolation
+		if ae, ok := err.(*AuthError); ok && ae.Code > 0 {
+			code = ae.Code
+		}
+		this.CloseWithCode(code, err.Error())
+		return err
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	a.timer.Stop()
+	if result.Identifier != "" {
+		this.identifier = result.Identifier
+	}
+	if result.Tag != "" {
+		this.tag = result.Tag
+	}
+	for key, value := range result.Attributes {
+		this.Set(key, value)
+	}
+	this.auth = nil
+	this.open()
+	return nil
+}
@@ -0,0 +1,167 @@
+package beetest
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smartwalle/bee"
+)
+
+const kTestTimeout = time.Second
+
+// echoHandler 在 Session 打开时发送 hello，之后回复收到的消息。
+type echoHandler struct {
+}
+
+func (this *echoHandler) DidOpenSession(s bee.Session) {
+	s.WriteMessage([]byte("hello"))
+}
+
+func (this *echoHandler) DidClosedSession(s bee.Session, err error) {
+}
+
+func (this *echoHandler) DidWrittenData(s bee.Session, data []byte) {
+}
+
+func (this *echoHandler) DidReceivedData(s bee.Session, data []byte) {
+	if data != nil {
+		s.WriteMessage(data)
+	}
+}
+
+func TestServer(t *testing.T) {
+	defer CheckLeaks(t)()
+
+	var server = NewServer(&echoHandler{}, WithPipeOptions(bee.WithPipeLatency(time.Millisecond)))
+	defer server.Close()
+
+	client, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Run(
+		Expect([]byte("hello"), kTestTimeout),
+		Send([]byte("ping")),
+		ExpectFunc(func(data []byte) error {
+			if string(data) != "ping" {
+				return fmt.Errorf("unexpected message %q", data)
+			}
+			return nil
+		}, kTestTimeout),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有更多的消息，Run 返回超时的步骤的错误
+	if err = client.Run(Sleep(time.Millisecond), Expect([]byte("ping"), 50*time.Millisecond)); err == nil {
+		t.Fatal("expected the last step to time out")
+	}
+
+	s, err := server.ExpectSession(kTestTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sl := server.Sessions(); len(sl) != 1 || sl[0] != s {
+		t.Fatalf("expected 1 session, got %d", len(sl))
+	}
+
+	if _, err = server.Recorder.Expect(kTestTimeout, func(e Event) bool {
+		return e.Type == EventWritten && string(e.Data) == "hello"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := server.Recorder.ExpectMessage(kTestTimeout)
+	if err != nil || string(data) != "ping" {
+		t.Fatalf("expected %q, got %q: %v", "ping", data, err)
+	}
+
+	if err = client.Run(Disconnect(), ExpectClose(kTestTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	e, err := server.Recorder.ExpectEvent(EventClosed, kTestTimeout)
+	if err != nil || e.Session != s {
+		t.Fatalf("expected server session to close: %v", err)
+	}
+	if len(server.Sessions()) != 0 {
+		t.Fatal("closed session still listed")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	defer CheckLeaks(t)()
+
+	var server = NewServer(nil)
+	var clients []*Client
+	for i := 0; i < 10; i++ {
+		client, err := server.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	server.Close()
+
+	for _, client := range clients {
+		if _, err := client.ExpectClosed(kTestTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := server.Dial(); err == nil {
+		t.Fatal("expected dial to fail after close")
+	}
+}
+
+func TestRejected(t *testing.T) {
+	defer CheckLeaks(t)()
+
+	// pipe 连接没有客户端证书，Session 会被拒绝
+	var identity = bee.WithCertIdentity(func(cert *x509.Certificate) (string, string, error) {
+		return cert.Subject.CommonName, "", nil
+	})
+
+	var server = NewServer(nil, WithSessionOptions(identity))
+	defer server.Close()
+
+	client, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.ExpectClosed(kTestTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Sessions()) != 0 {
+		t.Fatal("rejected session listed")
+	}
+
+	c, err := server.Listener().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewClient(c, identity); err != ErrRejected {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+}
+
+func TestCheckLeaks(t *testing.T) {
+	var server = NewServer(&echoHandler{})
+	defer server.Close()
+
+	var n = len(SessionGoroutines())
+	client, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WaitSessionGoroutines(n, 50*time.Millisecond); err == nil {
+		t.Fatal("expected running session goroutines to be reported")
+	}
+
+	client.Close()
+	server.Close()
+	if err = WaitSessionGoroutines(n, kTestTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package beetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/smartwalle/bee"
+	"time"
+)
+
+var (
+	ErrRejected = errors.New("beetest: session rejected")
+)
+
+// --------------------------------------------------------------------------------
+// Client 为测试用的客户端，Recorder 记录了客户端 Session 的所有回调。
+type Client struct {
+	Session  bee.Session
+	Recorder *Recorder
+}
+
+// NewClient 使用连接 c 创建客户端的 Session，Session 创建失败时（比如 opts 中的 bee.WithCertIdentity 拒绝了连接）返回 ErrRejected。
+func NewClient(c bee.Conn, opts ...bee.Option) (*Client, error) {
+	var client = &Client{}
+	client.Recorder = NewRecorder(nil)
+
+	// bee.NewSession 失败时返回的是 nil 指针，需要在转换为 bee.Session 之前检查
+	var s = bee.NewSession(c, client.Recorder, opts...)
+	if s == nil {
+		return nil, ErrRejected
+	}
+	client.Session = s
+	return client, nil
+}
+
+func (this *Client) Send(data []byte) error {
+	return this.Session.WriteMessage(data)
+}
+
+// ExpectMessage 等待收到下一条消息。
+func (this *Client) ExpectMessage(timeout time.Duration) ([]byte, error) {
+	return this.Recorder.ExpectMessage(timeout)
+}
+
+// ExpectClosed 等待 Session 关闭，返回 Session 关闭的原因。
+func (this *Client) ExpectClosed(timeout time.Duration) (reason error, err error) {
+	e, err := this.Recorder.ExpectEvent(EventClosed, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return e.Err, nil
+}
+
+func (this *Client) Close() error {
+	return this.Session.Close()
+}
+
+// Run 按照顺序执行 steps，返回第一个失败的步骤的错误。
+//
+//	err := client.Run(
+//		beetest.Send([]byte("ping")),
+//		beetest.Expect([]byte("pong"), time.Second),
+//		beetest.Disconnect(),
+//	)
+func (this *Client) Run(steps ...Step) error {
+	for i, step := range steps {
+		if err := step(this); err != nil {
+			return fmt.Errorf("beetest: step %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------------
+// Step 为 Client 的脚本中的一个步骤。
+type Step func(c *Client) error
+
+// Send 发送消息。
+func Send(data []byte) Step {
+	return func(c *Client) error {
+		return c.Send(data)
+	}
+}
+
+// Expect 等待收到下一条消息，并且消息的内容为 data。
+func Expect(data []byte, timeout time.Duration) Step {
+	return func(c *Client) error {
+		got, err := c.ExpectMessage(timeout)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(got, data) == false {
+			return fmt.Errorf("expected message %q, got %q", data, got)
+		}
+		return nil
+	}
+}
+
+// ExpectFunc 等待收到下一条消息，并使用 f 检查消息的内容。
+func ExpectFunc(f func(data []byte) error, timeout time.Duration) Step {
+	return func(c *Client) error {
+		got, err := c.ExpectMessage(timeout)
+		if err != nil {
+			return err
+		}
+		return f(got)
+	}
+}
+
+// ExpectClose 等待 Session 被关闭。
+func ExpectClose(timeout time.Duration) Step {
+	return func(c *Client) error {
+		_, err := c.ExpectClosed(timeout)
+		return err
+	}
+}
+
+// Sleep 等待 d。
+func Sleep(d time.Duration) Step {
+	return func(c *Client) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// Disconnect 关闭 Session。
+func Disconnect() Step {
+	return func(c *Client) error {
+		return c.Close()
+	}
+}
@@ -0,0 +1,66 @@
+package beetest
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	kLeakTimeout = 2 * time.Second
+
+	// Session 的 read、write 等 goroutine 都由 session 的方法创建
+	kSessionCreator = "created by github.com/smartwalle/bee.(*session)."
+)
+
+// SessionGoroutines 返回当前进程中由 bee.Session 创建并且还在运行的 goroutine 的调用栈。
+func SessionGoroutines() []string {
+	var buf = make([]byte, 1<<16)
+	for {
+		var n = runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	var gl []string
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		if strings.Contains(string(g), kSessionCreator) {
+			gl = append(gl, string(g))
+		}
+	}
+	return gl
+}
+
+// WaitSessionGoroutines 等待 Session 的 goroutine 数量不超过 n，超时之后返回仍然在运行的 goroutine 的调用栈。
+func WaitSessionGoroutines(n int, timeout time.Duration) error {
+	var deadline = time.Now().Add(timeout)
+	for {
+		var gl = SessionGoroutines()
+		if len(gl) <= n {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("beetest: %d session goroutines leaked:\n\n%s", len(gl)-n, strings.Join(gl, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// CheckLeaks 记录当前 Session 的 goroutine 数量，返回的函数等待 goroutine 恢复到该数量，超时则通过 t 报告泄漏的 goroutine：
+//
+//	defer beetest.CheckLeaks(t)()
+func CheckLeaks(t testing.TB) func() {
+	var n = len(SessionGoroutines())
+	return func() {
+		t.Helper()
+		if err := WaitSessionGoroutines(n, kLeakTimeout); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package beetest
+
+import (
+	"errors"
+	"github.com/smartwalle/bee"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTimeout = errors.New("beetest: timeout")
+)
+
+// --------------------------------------------------------------------------------
+type EventType int
+
+const (
+	EventOpened EventType = iota + 1
+	EventClosed
+	EventWritten
+	EventReceived
+	EventDatagram
+)
+
+func (this EventType) String() string {
+	switch this {
+	case EventOpened:
+		return "opened"
+	case EventClosed:
+		return "closed"
+	case EventWritten:
+		return "written"
+	case EventReceived:
+		return "received"
+	case EventDatagram:
+		return "datagram"
+	}
+	return "unknown"
+}
+
+// Event 为 Handler 的一次回调，Err 只有 EventClosed 会设置。
+// 读取出错时 EventReceived 的 Data 为 nil，出错的原因由之后的 EventClosed 的 Err 提供。
+type Event struct {
+	Type    EventType
+	Session bee.Session
+	Data    []byte
+	Err     error
+	Time    time.Time
+}
+
+type record struct {
+	Event
+	consumed bool
+}
+
+// --------------------------------------------------------------------------------
+// Recorder 实现了 bee.Handler 和 bee.DatagramHandler，按照顺序记录所有的回调，然后转发给被包装的 Handler（可以为 nil）。
+//
+// Events 返回所有记录的回调，Expect 等待并返回第一个满足条件并且没有被 Expect 返回过的回调。
+type Recorder struct {
+	handler bee.Handler
+
+	mu       sync.Mutex
+	records  []*record
+	sessions []bee.Session
+	changed  chan struct{}
+}
+
+func NewRecorder(handler bee.Handler) *Recorder {
+	var r = &Recorder{}
+	r.handler = handler
+	r.changed = make(chan struct{})
+	return r
+}
+
+func (this *Recorder) DidOpenSession(s bee.Session) {
+	this.record(EventOpened, s, nil, nil)
+	if this.handler != nil {
+		this.handler.DidOpenSession(s)
+	}
+}
+
+func (this *Recorder) DidClosedSession(s bee.Session, err error) {
+	this.record(EventClosed, s, nil, err)
+	if this.handler != nil {
+		this.handler.DidClosedSession(s, err)
+	}
+}
+
+func (this *Recorder) DidWrittenData(s bee.Session, data []byte) {
+	this.record(EventWritten, s, data, nil)
+	if this.handler != nil {
+		this.handler.DidWrittenData(s, data)
+	}
+}
+
+func (this *Recorder) DidReceivedData(s bee.Session, data []byte) {
+	this.record(EventReceived, s, data, nil)
+	if this.handler != nil {
+		this.handler.DidReceivedData(s, data)
+	}
+}
+
+func (this *Recorder) DidReceivedDatagram(s bee.Session, data []byte) {
+	this.record(EventDatagram, s, data, nil)
+	if h, ok := this.handler.(bee.DatagramHandler); ok {
+		h.DidReceivedDatagram(s, data)
+	}
+}
+
+func (this *Recorder) record(t EventType, s bee.Session, data []byte, err error) {
+	var e = Event{Type: t, Session: s, Err: err, Time: time.Now()}
+	if data != nil {
+		e.Data = append([]byte{}, data...)
+	}
+
+	this.mu.Lock()
+	this.records = append(this.records, &record{Event: e})
+	switch t {
+	case EventOpened:
+		this.sessions = append(this.sessions, s)
+	case EventClosed:
+		for i, c := range this.sessions {
+			if c == s {
+				this.sessions = append(this.sessions[:i:i], this.sessions[i+1:]...)
+				break
+			}
+		}
+	}
+	// 唤醒所有正在等待的 Expect
+	close(this.changed)
+	this.changed = make(chan struct{})
+	this.mu.Unlock()
+}
+
+// Events 按照回调的顺序返回所有记录的回调。
+func (this *Recorder) Events() []Event {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var el = make([]Event, 0, len(this.records))
+	for _, r := range this.records {
+		el = append(el, r.Event)
+	}
+	return el
+}
+
+// Sessions 返回已经打开并且没有关闭的 Session。
+func (this *Recorder) Sessions() []bee.Session {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]bee.Session(nil), this.sessions...)
+}
+
+// Reset 清除所有记录的回调。
+func (this *Recorder) Reset() {
+	this.mu.Lock()
+	this.records = nil
+	this.mu.Unlock()
+}
+
+// Expect 等待第一个满足 match 并且没有被 Expect 返回过的回调，超时返回 ErrTimeout。
+func (this *Recorder) Expect(timeout time.Duration, match func(e Event) bool) (Event, error) {
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		this.mu.Lock()
+		for _, r := range this.records {
+			if r.consumed == false && match(r.Event) {
+				r.consumed = true
+				this.mu.Unlock()
+				return r.Event, nil
+			}
+		}
+		var changed = this.changed
+		this.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return Event{}, ErrTimeout
+		}
+	}
+}
+
+// ExpectEvent 等待类型为 t 的回调。
+func (this *Recorder) ExpectEvent(t EventType, timeout time.Duration) (Event, error) {
+	return this.Expect(timeout, func(e Event) bool {
+		return e.Type == t
+	})
+}
+
+// ExpectMessage 等待收到的消息，读取出错时的回调不会被当作消息。
+func (this *Recorder) ExpectMessage(timeout time.Duration) ([]byte, error) {
+	e, err := this.Expect(timeout, func(e Event) bool {
+		return e.Type == EventReceived && e.Data != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.Data, nil
+}
@@ -0,0 +1,124 @@
+package beetest
+
+import (
+	"github.com/smartwalle/bee"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------
+type Option interface {
+	Apply(*Server)
+}
+
+type optionFunc func(*Server)
+
+func (f optionFunc) Apply(s *Server) {
+	f(s)
+}
+
+// WithPipeOptions 设置 Server 使用的 bee.PipeListener 的选项，比如延迟、带宽以及丢包率。
+func WithPipeOptions(opts ...bee.PipeOption) Option {
+	return optionFunc(func(s *Server) {
+		s.pipeOpts = append(s.pipeOpts, opts...)
+	})
+}
+
+// WithSessionOptions 设置 Server 创建 Session 时使用的选项。
+func WithSessionOptions(opts ...bee.Option) Option {
+	return optionFunc(func(s *Server) {
+		s.sessionOpts = append(s.sessionOpts, opts...)
+	})
+}
+
+// --------------------------------------------------------------------------------
+// Server 为基于 bee.PipeListener 的测试服务端，不占用端口，Recorder 记录了服务端所有 Session 的回调。
+type Server struct {
+	Recorder *Recorder
+
+	listener    *bee.PipeListener
+	pipeOpts    []bee.PipeOption
+	sessionOpts []bee.Option
+	closeOnce   sync.Once
+	done        chan struct{}
+
+	// accepted 记录所有创建的 Session，包括还没有通过认证的 Session
+	mu       sync.Mutex
+	accepted []bee.Session
+}
+
+// NewServer 创建并启动 Server，handler 可以为 nil。
+func NewServer(handler bee.Handler, opts ...Option) *Server {
+	var s = &Server{}
+	s.Recorder = NewRecorder(handler)
+	s.done = make(chan struct{})
+
+	for _, opt := range opts {
+		opt.Apply(s)
+	}
+
+	s.listener = bee.ListenPipe("beetest", s.pipeOpts...)
+	go s.serve()
+	return s
+}
+
+func (this *Server) serve() {
+	defer close(this.done)
+	for {
+		c, err := this.listener.Accept()
+		if err != nil {
+			return
+		}
+		var s = bee.NewSession(c, this.Recorder, this.sessionOpts...)
+		if s == nil {
+			// 连接被拒绝，比如使用 bee.WithCertIdentity 时 pipe 连接没有证书
+			continue
+		}
+		this.mu.Lock()
+		this.accepted = append(this.accepted, s)
+		this.mu.Unlock()
+	}
+}
+
+func (this *Server) Listener() *bee.PipeListener {
+	return this.listener
+}
+
+// Dial 创建一个连接到 Server 的 Client。
+func (this *Server) Dial(opts ...bee.Option) (*Client, error) {
+	c, err := this.listener.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c, opts...)
+}
+
+// ExpectSession 等待服务端打开一个新的 Session。
+func (this *Server) ExpectSession(timeout time.Duration) (bee.Session, error) {
+	e, err := this.Recorder.ExpectEvent(EventOpened, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return e.Session, nil
+}
+
+// Sessions 返回服务端已经打开并且没有关闭的 Session。
+func (this *Server) Sessions() []bee.Session {
+	return this.Recorder.Sessions()
+}
+
+// Close 停止接受新的连接，并关闭服务端所有的 Session。
+func (this *Server) Close() {
+	this.closeOnce.Do(func() {
+		this.listener.Close()
+		<-this.done
+
+		this.mu.Lock()
+		var sl = this.accepted
+		this.accepted = nil
+		this.mu.Unlock()
+		for _, s := range sl {
+			s.Close()
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type MessageType byte
+
+const (
+	// MessageAdd 节点上添加了 Session
+	MessageAdd MessageType = iota + 1
+
+	// MessageRemove 节点上移除了 Session
+	MessageRemove
+
+	// MessageWrite 向 Identifier 及 Tag 对应的 Session 发送 Data，Tag 为空时发送给 Identifier 的所有 Session
+	MessageWrite
+
+	// MessageBroadcast 向节点上的所有 Session 发送 Data
+	MessageBroadcast
+
+	// MessageClose 使用 Code 及 Data 关闭 Identifier 及 Tag 对应的 Session
+	MessageClose
+
+	// MessageNodeJoin 由 Broker 产生，表示已经可以向 Node 发送消息
+	MessageNodeJoin
+
+	// MessageNodeLeave 由 Broker 产生，表示与 Node 的连接已经断开
+	MessageNodeLeave
+)
+
+var (
+	ErrBadMessage   = errors.New("cluster: bad message")
+	ErrUnknownNode  = errors.New("cluster: unknown node")
+	ErrBrokerClosed = errors.New("cluster: broker is closed")
+)
+
+// --------------------------------------------------------------------------------
+type Message struct {
+	Type       MessageType
+	Node       string // 消息来源节点
+	Identifier string
+	Tag        string
+	Code       int
+	Data       []byte
+}
+
+// Broker 负责节点之间的消息传递。
+type Broker interface {
+	// Node 返回当前节点的 ID，集群中每个节点的 ID 必须唯一
+	Node() string
+
+	// Start 开始接收其它节点的消息，h 可能被并发调用
+	Start(h func(m *Message)) error
+
+	// Publish 向所有其它节点发送消息
+	Publish(m *Message) error
+
+	// Send 向指定节点发送消息
+	Send(node string, m *Message) error
+
+	Close() error
+}
+
+// --------------------------------------------------------------------------------
+func (this *Message) Marshal() []byte {
+	var b = make([]byte, 0, 1+binary.MaxVarintLen64*5+len(this.Node)+len(this.Identifier)+len(this.Tag)+len(this.Data))
+	b = append(b, byte(this.Type))
+	b = appendBytes(b, []byte(this.Node))
+	b = appendBytes(b, []byte(this.Identifier))
+	b = appendBytes(b, []byte(this.Tag))
+
+	var buf [binary.MaxVarintLen64]byte
+	var n = binary.PutVarint(buf[:], int64(this.Code))
+	b = append(b, buf[:n]...)
+	return appendBytes(b, this.Data)
+}
+
+func (this *Message) Unmarshal(b []byte) (err error) {
+	if len(b) < 1 {
+		return ErrBadMessage
+	}
+	this.Type = MessageType(b[0])
+	b = b[1:]
+
+	var v []byte
+	if v, b, err = readBytes(b); err != nil {
+		return err
+	}
+	this.Node = string(v)
+	if v, b, err = readBytes(b); err != nil {
+		return err
+	}
+	this.Identifier = string(v)
+	if v, b, err = readBytes(b); err != nil {
+		return err
+	}
+	this.Tag = string(v)
+
+	code, n := binary.Varint(b)
+	if n <= 0 {
+		return ErrBadMessage
+	}
+	this.Code = int(code)
+	b = b[n:]
+
+	if v, _, err = readBytes(b); err != nil {
+		return err
+	}
+	if len(v) > 0 {
+		this.Data = v
+	}
+	return nil
+}
+
+func appendBytes(b, v []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	var n = binary.PutUvarint(buf[:], uint64(len(v)))
+	b = append(b, buf[:n]...)
+	return append(b, v...)
+}
+
+func readBytes(b []byte) (v, rest []byte, err error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return nil, nil, ErrBadMessage
+	}
+	return b[n : n+int(l)], b[n+int(l):], nil
+}
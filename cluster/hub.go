@@ -0,0 +1,324 @@
+package cluster
+
+import (
+	"github.com/smartwalle/bee"
+	"sync"
+)
+
+const (
+	kDefaultTag = "default"
+)
+
+// --------------------------------------------------------------------------------
+// Hub 在本地 Hub 的基础上，通过 Broker 与其它节点同步 Session 信息，实现跨节点的 bee.Hub。
+// GetSession 等方法在本地找不到对应的 Session 时，会返回其它节点上的 Session 的代理对象，
+// 代理对象的 WriteMessage、Write 及 Close 等方法将通过 Broker 转发到 Session 所在的节点执行，
+// Conn、LocalAddr 及 RemoteAddr 返回 nil，Set、Get 及 Del 只作用于当前代理对象。
+type Hub struct {
+	local bee.Hub
+	b     Broker
+
+	mu     sync.RWMutex
+	remote map[string]map[string]map[string]struct{} // identifier -> node -> tags
+	count  int64
+}
+
+// NewHub 创建集群 Hub，local 用于管理当前节点上的 Session，为 nil 时使用 bee.NewHub()。
+func NewHub(local bee.Hub, b Broker) (*Hub, error) {
+	if local == nil {
+		local = bee.NewHub()
+	}
+	var h = &Hub{}
+	h.local = local
+	h.b = b
+	h.remote = make(map[string]map[string]map[string]struct{})
+	if err := b.Start(h.handle); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (this *Hub) Local() bee.Hub {
+	return this.local
+}
+
+func (this *Hub) AddSession(s bee.Session) {
+	this.TryAddSession(s)
+}
+
+func (this *Hub) TryAddSession(s bee.Session) error {
+	if s == nil {
+		return nil
+	}
+	if err := this.local.TryAddSession(s); err != nil {
+		return err
+	}
+	this.b.Publish(&Message{Type: MessageAdd, Node: this.b.Node(), Identifier: s.Identifier(), Tag: s.Tag()})
+	return nil
+}
+
+func (this *Hub) GetSession(identifier, tag string) bee.Session {
+	if s := this.local.GetSession(identifier, tag); s != nil {
+		return s
+	}
+
+	if tag == "" {
+		tag = kDefaultTag
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for node, tags := range this.remote[identifier] {
+		if _, ok := tags[tag]; ok {
+			return newRemoteSession(this, node, identifier, tag)
+		}
+	}
+	return nil
+}
+
+func (this *Hub) GetSessions(identifier string) []bee.Session {
+	var sl = this.local.GetSessions(identifier)
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for node, tags := range this.remote[identifier] {
+		for tag := range tags {
+			sl = append(sl, newRemoteSession(this, node, identifier, tag))
+		}
+	}
+	return sl
+}
+
+func (this *Hub) GetAllSessions() []bee.Session {
+	var sl = this.local.GetAllSessions()
+	this.rangeRemote(func(s bee.Session) bool {
+		sl = append(sl, s)
+		return true
+	})
+	return sl
+}
+
+func (this *Hub) Range(f func(s bee.Session) bool) {
+	var next = true
+	this.local.Range(func(s bee.Session) bool {
+		next = f(s)
+		return next
+	})
+	if next {
+		this.rangeRemote(f)
+	}
+}
+
+func (this *Hub) rangeRemote(f func(s bee.Session) bool) {
+	this.mu.RLock()
+	var sl = make([]bee.Session, 0, this.count)
+	for identifier, nodes := range this.remote {
+		for node, tags := range nodes {
+			for tag := range tags {
+				sl = append(sl, newRemoteSession(this, node, identifier, tag))
+			}
+		}
+	}
+	this.mu.RUnlock()
+
+	for _, s := range sl {
+		if f(s) == false {
+			return
+		}
+	}
+}
+
+func (this *Hub) RemoveSession(s bee.Session) {
+	if s == nil {
+		return
+	}
+	if rs, ok := s.(*remoteSession); ok {
+		rs.Close()
+		return
+	}
+
+	this.local.RemoveSession(s)
+
+	// 相同 identifier 及 tag 的 Session 可能已经被新的 Session 替换
+	if this.local.GetSession(s.Identifier(), s.Tag()) == nil {
+		this.b.Publish(&Message{Type: MessageRemove, Node: this.b.Node(), Identifier: s.Identifier(), Tag: s.Tag()})
+	}
+}
+
+// RemoveSessions 只移除当前节点上 identifier 对应的 Session。
+func (this *Hub) RemoveSessions(identifier string) {
+	var sl = this.local.GetSessions(identifier)
+	this.local.RemoveSessions(identifier)
+	for _, s := range sl {
+		this.b.Publish(&Message{Type: MessageRemove, Node: this.b.Node(), Identifier: s.Identifier(), Tag: s.Tag()})
+	}
+}
+
+// Len 返回整个集群中 Session 的数量。
+func (this *Hub) Len() int64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.local.Len() + this.count
+}
+
+// Find 只查找当前节点上的 Session，其它节点上的 Session 的属性不会同步到当前节点。
+func (this *Hub) Find(f func(s bee.Session) bool) []bee.Session {
+	return this.local.Find(f)
+}
+
+// FindBy 只查找当前节点上的 Session。
+func (this *Hub) FindBy(key string, value interface{}) []bee.Session {
+	return this.local.FindBy(key, value)
+}
+
+// AddObserver 观察当前节点上的 Session 的变化。
+func (this *Hub) AddObserver(o bee.HubObserver) {
+	this.local.AddObserver(o)
+}
+
+func (this *Hub) RemoveObserver(o bee.HubObserver) {
+	this.local.RemoveObserver(o)
+}
+
+func (this *Hub) Stats() bee.HubStats {
+	var stats = this.local.Stats()
+	stats.Sessions = this.Len()
+	return stats
+}
+
+// SendTo 向整个集群中 identifier 及 tag 对应的 Session 发送消息，tag 为空时发送给 identifier 的所有 Session。
+func (this *Hub) SendTo(identifier, tag string, data []byte) {
+	if tag == "" {
+		for _, s := range this.local.GetSessions(identifier) {
+			s.WriteMessage(data)
+		}
+	} else if s := this.local.GetSession(identifier, tag); s != nil {
+		s.WriteMessage(data)
+	}
+
+	this.mu.RLock()
+	var nodes = make([]string, 0, len(this.remote[identifier]))
+	for node, tags := range this.remote[identifier] {
+		if _, ok := tags[tag]; ok || tag == "" {
+			nodes = append(nodes, node)
+		}
+	}
+	this.mu.RUnlock()
+
+	for _, node := range nodes {
+		this.b.Send(node, &Message{Type: MessageWrite, Node: this.b.Node(), Identifier: identifier, Tag: tag, Data: data})
+	}
+}
+
+// Broadcast 向整个集群中的所有 Session 发送消息。
+func (this *Hub) Broadcast(data []byte) {
+	this.broadcastLocal(data)
+	this.b.Publish(&Message{Type: MessageBroadcast, Node: this.b.Node(), Data: data})
+}
+
+func (this *Hub) Close() error {
+	return this.b.Close()
+}
+
+func (this *Hub) broadcastLocal(data []byte) {
+	this.local.Range(func(s bee.Session) bool {
+		s.WriteMessage(data)
+		return true
+	})
+}
+
+func (this *Hub) handle(m *Message) {
+	switch m.Type {
+	case MessageAdd:
+		this.addRemote(m.Node, m.Identifier, m.Tag)
+	case MessageRemove:
+		this.removeRemote(m.Node, m.Identifier, m.Tag)
+	case MessageWrite:
+		if m.Tag == "" {
+			for _, s := range this.local.GetSessions(m.Identifier) {
+				s.WriteMessage(m.Data)
+			}
+		} else if s := this.local.GetSession(m.Identifier, m.Tag); s != nil {
+			s.WriteMessage(m.Data)
+		}
+	case MessageBroadcast:
+		this.broadcastLocal(m.Data)
+	case MessageClose:
+		var sl []bee.Session
+		if m.Tag == "" {
+			sl = this.local.GetSessions(m.Identifier)
+		} else if s := this.local.GetSession(m.Identifier, m.Tag); s != nil {
+			sl = append(sl, s)
+		}
+		for _, s := range sl {
+			if m.Code > 0 {
+				s.CloseWithCode(m.Code, string(m.Data))
+			} else {
+				s.Close()
+			}
+		}
+	case MessageNodeJoin:
+		// 将当前节点上的 Session 同步给新加入的节点
+		this.local.Range(func(s bee.Session) bool {
+			this.b.Send(m.Node, &Message{Type: MessageAdd, Node: this.b.Node(), Identifier: s.Identifier(), Tag: s.Tag()})
+			return true
+		})
+	case MessageNodeLeave:
+		this.removeNode(m.Node)
+	}
+}
+
+func (this *Hub) addRemote(node, identifier, tag string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var nodes = this.remote[identifier]
+	if nodes == nil {
+		nodes = make(map[string]map[string]struct{})
+		this.remote[identifier] = nodes
+	}
+	var tags = nodes[node]
+	if tags == nil {
+		tags = make(map[string]struct{})
+		nodes[node] = tags
+	}
+	if _, ok := tags[tag]; ok == false {
+		tags[tag] = struct{}{}
+		this.count++
+	}
+}
+
+func (this *Hub) removeRemote(node, identifier, tag string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var nodes = this.remote[identifier]
+	var tags = nodes[node]
+	if _, ok := tags[tag]; ok {
+		delete(tags, tag)
+		this.count--
+	}
+	if len(tags) == 0 {
+		delete(nodes, node)
+	}
+	if len(nodes) == 0 {
+		delete(this.remote, identifier)
+	}
+}
+
+func (this *Hub) removeNode(node string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for identifier, nodes := range this.remote {
+		if tags, ok := nodes[node]; ok {
+			this.count -= int64(len(tags))
+			delete(nodes, node)
+		}
+		if len(nodes) == 0 {
+			delete(this.remote, identifier)
+		}
+	}
+}
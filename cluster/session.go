@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"github.com/smartwalle/bee"
+	"net"
+	"sync"
+)
+
+// --------------------------------------------------------------------------------
+// remoteSession 为其它节点上的 Session 的代理。
+type remoteSession struct {
+	h          *Hub
+	node       string
+	identifier string
+	tag        string
+
+	mu   sync.Mutex
+	data map[string]interface{}
+}
+
+func newRemoteSession(h *Hub, node, identifier, tag string) *remoteSession {
+	return &remoteSession{h: h, node: node, identifier: identifier, tag: tag}
+}
+
+// Node 返回 Session 所在节点的 ID。
+func (this *remoteSession) Node() string {
+	return this.node
+}
+
+func (this *remoteSession) Identifier() string {
+	return this.identifier
+}
+
+func (this *remoteSession) Tag() string {
+	return this.tag
+}
+
+func (this *remoteSession) Set(key string, value interface{}) {
+	if value != nil {
+		this.mu.Lock()
+		if this.data == nil {
+			this.data = make(map[string]interface{})
+		}
+		this.data[key] = value
+		this.mu.Unlock()
+	}
+}
+
+func (this *remoteSession) Get(key string) interface{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.data[key]
+}
+
+func (this *remoteSession) Del(key string) {
+	this.mu.Lock()
+	delete(this.data, key)
+	this.mu.Unlock()
+}
+
+func (this *remoteSession) Conn() bee.Conn {
+	return nil
+}
+
+func (this *remoteSession) LocalAddr() net.Addr {
+	return nil
+}
+
+func (this *remoteSession) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (this *remoteSession) ConnectionState() (state tls.ConnectionState, ok bool) {
+	return state, false
+}
+
+func (this *remoteSession) WriteMessage(data []byte) (err error) {
+	return this.h.b.Send(this.node, &Message{Type: MessageWrite, Node: this.h.b.Node(), Identifier: this.identifier, Tag: this.tag, Data: data})
+}
+
+// WriteMessageWith 转发到远程节点之后使用默认的选项发送，opts 被忽略。
+func (this *remoteSession) WriteMessageWith(data []byte, opts ...bee.MessageOption) (err error) {
+	return this.WriteMessage(data)
+}
+
+func (this *remoteSession) Write(data []byte) (n int, err error) {
+	if err = this.WriteMessage(data); err != nil {
+		return -1, err
+	}
+	return len(data), nil
+}
+
+// Stats 远程 Session 的发送队列位于其所在的节点，返回零值。
+func (this *remoteSession) Stats() bee.SessionStats {
+	return bee.SessionStats{}
+}
+
+func (this *remoteSession) WriteDatagram(data []byte) (err error) {
+	return bee.ErrDatagramNotSupported
+}
+
+func (this *remoteSession) Close() error {
+	return this.CloseWithCode(0, "")
+}
+
+func (this *remoteSession) CloseWithCode(code int, reason string) error {
+	return this.h.b.Send(this.node, &Message{Type: MessageClose, Node: this.h.b.Node(), Identifier: this.identifier, Tag: this.tag, Code: code, Data: []byte(reason)})
+}
@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/smartwalle/bee"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultMaxMessageSize  = 4 * 1024 * 1024
+	kDefaultWriteBufferSize = 1024
+	kDefaultRetryInterval   = time.Second
+	kDefaultDialTimeout     = 5 * time.Second
+
+	messageHello MessageType = 0xff
+)
+
+// --------------------------------------------------------------------------------
+// TCPBroker 使用 bee 自身的 TCP 传输在节点之间建立全互联的连接，每个节点监听 addr，并主动连接 peers 中的所有节点，
+// 连接断开之后会自动重连。peers 中可以包含当前节点的地址，会被忽略。
+//
+//	var b = cluster.NewTCPBroker("node1", "127.0.0.1:9001", "127.0.0.1:9001", "127.0.0.1:9002", "127.0.0.1:9003")
+//	h, err := cluster.NewHub(bee.NewHub(), b)
+//
+// 注意: 节点之间的消息没有认证，任何可以连接到 addr 的客户端都可以冒充节点发送消息。
+// 节点不在可信网络中时，需要设置 ServerTLSConfig 及 ClientTLSConfig，并且服务端使用 tls.RequireAndVerifyClientCert 校验对端节点的证书：
+//
+//	b.ServerTLSConfig = &tls.Config{Certificates: certs, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+//	b.ClientTLSConfig = &tls.Config{Certificates: certs, RootCAs: pool}
+type TCPBroker struct {
+	node  string
+	addr  string
+	peers []string
+
+	RetryInterval time.Duration
+
+	// ServerTLSConfig 不为空时，使用 TLS 监听 addr
+	ServerTLSConfig *tls.Config
+
+	// ClientTLSConfig 不为空时，使用 TLS 连接其它节点
+	ClientTLSConfig *tls.Config
+
+	h         func(m *Message)
+	ln        listener
+	mu        sync.RWMutex
+	out       map[string]bee.Session
+	in        map[bee.Session]string
+	inCount   map[string]int
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewTCPBroker(node, addr string, peers ...string) *TCPBroker {
+	var b = &TCPBroker{}
+	b.node = node
+	b.addr = addr
+	b.peers = peers
+	b.RetryInterval = kDefaultRetryInterval
+	b.out = make(map[string]bee.Session)
+	b.in = make(map[bee.Session]string)
+	b.inCount = make(map[string]int)
+	b.closed = make(chan struct{})
+	return b
+}
+
+func (this *TCPBroker) Node() string {
+	return this.node
+}
+
+func (this *TCPBroker) Start(h func(m *Message)) error {
+	var ln listener
+	var err error
+	if this.ServerTLSConfig != nil {
+		ln, err = bee.ListenTLS("tcp", this.addr, this.ServerTLSConfig)
+	} else {
+		ln, err = bee.Listen("tcp", this.addr)
+	}
+	if err != nil {
+		return err
+	}
+	this.h = h
+	this.ln = ln
+
+	go this.accept()
+	for _, peer := range this.peers {
+		if peer != this.addr {
+			go this.dial(peer)
+		}
+	}
+	return nil
+}
+
+func (this *TCPBroker) Publish(m *Message) (err error) {
+	var data = m.Marshal()
+
+	this.mu.RLock()
+	var sl = make([]bee.Session, 0, len(this.out))
+	for _, s := range this.out {
+		sl = append(sl, s)
+	}
+	this.mu.RUnlock()
+
+	for _, s := range sl {
+		if sErr := s.WriteMessage(data); sErr != nil && err == nil {
+			err = sErr
+		}
+	}
+	return err
+}
+
+func (this *TCPBroker) Send(node string, m *Message) error {
+	this.mu.RLock()
+	var s = this.out[node]
+	this.mu.RUnlock()
+
+	if s == nil {
+		return ErrUnknownNode
+	}
+	return s.WriteMessage(m.Marshal())
+}
+
+func (this *TCPBroker) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+
+	var err error
+	if this.ln != nil {
+		err = this.ln.Close()
+	}
+
+	this.mu.RLock()
+	var sl = make([]bee.Session, 0, len(this.out)+len(this.in))
+	for _, s := range this.out {
+		sl = append(sl, s)
+	}
+	for s := range this.in {
+		sl = append(sl, s)
+	}
+	this.mu.RUnlock()
+
+	for _, s := range sl {
+		s.Close()
+	}
+	return err
+}
+
+func (this *TCPBroker) options() []bee.Option {
+	return []bee.Option{bee.WithMaxMessageSize(kDefaultMaxMessageSize), bee.WithWriteBufferSize(kDefaultWriteBufferSize)}
+}
+
+func (this *TCPBroker) accept() {
+	for {
+		c, err := this.ln.Accept()
+		if err != nil {
+			return
+		}
+		bee.NewSession(c, &inHandler{b: this}, this.options()...)
+	}
+}
+
+func (this *TCPBroker) dial(addr string) {
+	for {
+		select {
+		case <-this.closed:
+			return
+		default:
+		}
+
+		var d = &bee.Dialer{TLSConfig: this.ClientTLSConfig}
+		var ctx, cancel = context.WithTimeout(context.Background(), kDefaultDialTimeout)
+		c, err := d.DialContext(ctx, "tcp", addr)
+		cancel()
+		if err == nil {
+			var oh = &outHandler{b: this, done: make(chan struct{})}
+			var s = bee.NewSession(c, oh, this.options()...)
+			if s != nil {
+				s.WriteMessage((&Message{Type: messageHello, Node: this.node}).Marshal())
+
+				select {
+				case <-oh.done:
+				case <-this.closed:
+					s.Close()
+					return
+				}
+			}
+		}
+
+		select {
+		case <-time.After(this.RetryInterval):
+		case <-this.closed:
+			return
+		}
+	}
+}
+
+type listener interface {
+	Accept() (bee.Conn, error)
+	Close() error
+}
+
+// --------------------------------------------------------------------------------
+// inHandler 处理其它节点主动建立的连接，用于接收消息。
+type inHandler struct {
+	b *TCPBroker
+}
+
+func (this *inHandler) DidOpenSession(s bee.Session) {
+}
+
+func (this *inHandler) DidClosedSession(s bee.Session, err error) {
+	var b = this.b
+
+	b.mu.Lock()
+	node, ok := b.in[s]
+	delete(b.in, s)
+	var leave = false
+	if ok {
+		b.inCount[node]--
+		if b.inCount[node] <= 0 {
+			delete(b.inCount, node)
+			leave = true
+		}
+	}
+	b.mu.Unlock()
+
+	if leave {
+		b.h(&Message{Type: MessageNodeLeave, Node: node})
+	}
+}
+
+func (this *inHandler) DidWrittenData(s bee.Session, data []byte) {
+}
+
+func (this *inHandler) DidReceivedData(s bee.Session, data []byte) {
+	if data == nil {
+		return
+	}
+
+	var m = &Message{}
+	if err := m.Unmarshal(data); err != nil {
+		return
+	}
+
+	var b = this.b
+	if m.Type == messageHello {
+		b.mu.Lock()
+		if _, ok := b.in[s]; ok == false {
+			b.in[s] = m.Node
+			b.inCount[m.Node]++
+		}
+		b.mu.Unlock()
+
+		s.WriteMessage((&Message{Type: messageHello, Node: b.node}).Marshal())
+		return
+	}
+
+	b.mu.RLock()
+	_, ok := b.in[s]
+	b.mu.RUnlock()
+
+	if ok {
+		b.h(m)
+	}
+}
+
+// --------------------------------------------------------------------------------
+// outHandler 处理当前节点主动建立的连接，用于发送消息。
+type outHandler struct {
+	b    *TCPBroker
+	node string
+	done chan struct{}
+}
+
+func (this *outHandler) DidOpenSession(s bee.Session) {
+}
+
+func (this *outHandler) DidClosedSession(s bee.Session, err error) {
+	var b = this.b
+
+	b.mu.Lock()
+	if this.node != "" && b.out[this.node] == s {
+		delete(b.out, this.node)
+	}
+	b.mu.Unlock()
+
+	close(this.done)
+}
+
+func (this *outHandler) DidWrittenData(s bee.Session, data []byte) {
+}
+
+func (this *outHandler) DidReceivedData(s bee.Session, data []byte) {
+	if data == nil {
+		return
+	}
+
+	var m = &Message{}
+	if err := m.Unmarshal(data); err != nil || m.Type != messageHello {
+		return
+	}
+
+	var b = this.b
+	b.mu.Lock()
+	this.node = m.Node
+	b.out[m.Node] = s
+	b.mu.Unlock()
+
+	b.h(&Message{Type: MessageNodeJoin, Node: m.Node})
+}
@@ -0,0 +1,222 @@
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/smartwalle/bee"
+)
+
+const kTestTimeout = 3 * time.Second
+
+type testHandler struct {
+	received chan string
+}
+
+func (this *testHandler) DidOpenSession(s bee.Session) {
+}
+
+func (this *testHandler) DidClosedSession(s bee.Session, err error) {
+}
+
+func (this *testHandler) DidWrittenData(s bee.Session, data []byte) {
+}
+
+func (this *testHandler) DidReceivedData(s bee.Session, data []byte) {
+	if data != nil {
+		this.received <- string(data)
+	}
+}
+
+func freeAddrs(t *testing.T, n int) []string {
+	var addrs = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		ln.Close()
+	}
+	return addrs
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	var deadline = time.Now().Add(kTestTimeout)
+	for f() == false {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func connected(b *TCPBroker) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.out)
+}
+
+func startCluster(t *testing.T, setup func(b *TCPBroker)) ([]*Hub, []*TCPBroker) {
+	var addrs = freeAddrs(t, 3)
+	var hubs []*Hub
+	var brokers []*TCPBroker
+	for i, addr := range addrs {
+		var b = NewTCPBroker(string(rune('a'+i)), addr, addrs...)
+		b.RetryInterval = 50 * time.Millisecond
+		if setup != nil {
+			setup(b)
+		}
+		h, err := NewHub(nil, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hubs = append(hubs, h)
+		brokers = append(brokers, b)
+	}
+	t.Cleanup(func() {
+		for _, h := range hubs {
+			h.Close()
+		}
+	})
+	return hubs, brokers
+}
+
+// addClient 在 h 所在的节点上添加一个 identifier 为 id 的 Session，返回客户端接收到的消息。
+func addClient(t *testing.T, h *Hub, id string) chan string {
+	var ln = bee.ListenPipe("cluster")
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		h.AddSession(bee.NewSession(c, &testHandler{received: make(chan string, 8)}, bee.WithIdentifier(id)))
+	}()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client = &testHandler{received: make(chan string, 8)}
+	var s = bee.NewSession(c, client)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return client.received
+}
+
+func expect(t *testing.T, received chan string, data string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		if got != data {
+			t.Fatalf("expected %q, got %q", data, got)
+		}
+	case <-time.After(kTestTimeout):
+		t.Fatalf("timeout waiting for %q", data)
+	}
+}
+
+func TestTCPBroker(t *testing.T) {
+	hubs, brokers := startCluster(t, nil)
+	for _, b := range brokers {
+		waitFor(t, "nodes to connect", func() bool { return connected(b) == 2 })
+	}
+
+	var received = addClient(t, hubs[0], "u1")
+	waitFor(t, "session to sync", func() bool {
+		return hubs[1].GetSession("u1", "") != nil && hubs[2].Len() == 1
+	})
+
+	if err := hubs[1].GetSession("u1", "").WriteMessage([]byte("get")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, received, "get")
+
+	hubs[2].SendTo("u1", "", []byte("send"))
+	expect(t, received, "send")
+
+	hubs[1].Broadcast([]byte("broadcast"))
+	expect(t, received, "broadcast")
+
+	hubs[0].Close()
+	waitFor(t, "node to leave", func() bool {
+		return hubs[1].GetSession("u1", "") == nil && hubs[2].Len() == 0
+	})
+}
+
+func TestTCPBrokerTLS(t *testing.T) {
+	var ca, cert = testCertificates(t)
+	var pool = x509.NewCertPool()
+	pool.AddCert(ca)
+
+	hubs, brokers := startCluster(t, func(b *TCPBroker) {
+		b.ServerTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+		b.ClientTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: "bee"}
+	})
+	for _, b := range brokers {
+		waitFor(t, "nodes to connect", func() bool { return connected(b) == 2 })
+	}
+
+	var received = addClient(t, hubs[0], "u1")
+	waitFor(t, "session to sync", func() bool { return hubs[2].GetSession("u1", "") != nil })
+	hubs[2].SendTo("u1", "", []byte("tls"))
+	expect(t, received, "tls")
+
+	// 没有客户端证书的节点不能连接到集群
+	var addr = brokers[0].addr
+	var intruder = NewTCPBroker("x", freeAddrs(t, 1)[0], addr)
+	intruder.ClientTLSConfig = &tls.Config{RootCAs: pool, ServerName: "bee"}
+	if err := intruder.Start(func(m *Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	brokers[0].mu.RLock()
+	var joined = brokers[0].inCount["x"]
+	brokers[0].mu.RUnlock()
+	if connected(intruder) != 0 || joined != 0 {
+		t.Fatal("node without client certificate joined the cluster")
+	}
+}
+
+func testCertificates(t *testing.T) (*x509.Certificate, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tpl = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bee"},
+		DNSNames:              []string{"bee"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -2,6 +2,7 @@ package bee
 
 import (
 	"bufio"
+	"crypto/tls"
 	"github.com/smartwalle/bee/conn"
 	"io"
 	"net"
@@ -30,6 +31,41 @@ type Conn interface {
 	ReadMessage() (messageType int, p []byte, err error)
 }
 
+// DatagramConn 由支持不可靠数据报的连接实现（比如启用了 DATAGRAM 扩展的 QUIC 连接）。
+type DatagramConn interface {
+	WriteDatagram(data []byte) error
+
+	ReadDatagram() ([]byte, error)
+}
+
+func datagramConn(c Conn) DatagramConn {
+	if dc, ok := c.(DatagramConn); ok {
+		return dc
+	}
+	if uc, ok := c.(interface{ UnderlyingConn() net.Conn }); ok {
+		if dc, ok := uc.UnderlyingConn().(DatagramConn); ok {
+			return dc
+		}
+	}
+	return nil
+}
+
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+func connectionState(c Conn) (tls.ConnectionState, bool) {
+	if tc, ok := c.(tlsConn); ok {
+		return tc.ConnectionState(), true
+	}
+	if uc, ok := c.(interface{ UnderlyingConn() net.Conn }); ok {
+		if tc, ok := uc.UnderlyingConn().(tlsConn); ok {
+			return tc.ConnectionState(), true
+		}
+	}
+	return tls.ConnectionState{}, false
+}
+
 func NewConn(c net.Conn, isServer bool, readBufferSize, writeBufferSize int, writeBufferPool conn.BufferPool, br *bufio.Reader, writeBuf []byte) *conn.Conn {
 	return conn.NewConn(c, isServer, readBufferSize, writeBufferSize, writeBufferPool, br, writeBuf)
 }
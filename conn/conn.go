@@ -270,6 +270,7 @@ type Conn struct {
 	handleClose   func(int, string) error
 	readErrCount  int
 	messageReader *messageReader // the current low-level reader
+	readBoundary  bool           // true if the last read stopped between messages.
 }
 
 func NewConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int, writeBufferPool BufferPool, br *bufio.Reader, writeBuf []byte) *Conn {
@@ -349,6 +350,10 @@ func (c *Conn) read(n int) ([]byte, error) {
 	if err == io.EOF {
 		err = errUnexpectedEOF
 	}
+	if err != nil {
+		// Keep the partial data buffered so that Detach can hand it over.
+		return p, err
+	}
 	c.br.Discard(len(p))
 	return p, err
 }
@@ -744,10 +749,12 @@ func (c *Conn) advanceFrame() (int, error) {
 
 	// 2. Read and parse first two bytes of frame header.
 
+	c.readBoundary = c.readRemaining == 0 && c.readFinal
 	p, err := c.read(2)
 	if err != nil {
 		return noFrame, err
 	}
+	c.readBoundary = false
 
 	final := p[0]&finalBit != 0
 	frameType := int(p[0] & 0xf)
@@ -1081,6 +1088,33 @@ func (c *Conn) UnderlyingConn() net.Conn {
 	return c.conn
 }
 
+// IsServer returns true if the connection is the server side of the protocol.
+func (c *Conn) IsServer() bool {
+	return c.isServer
+}
+
+// ErrNotAtBoundary is returned by Detach when the connection stopped reading
+// in the middle of a message.
+var ErrNotAtBoundary = errors.New("websocket: read stopped in the middle of a message")
+
+// Detach returns the internal net.Conn together with the data that has been
+// buffered but not yet processed, so that the connection can be continued by
+// another Conn, possibly in another process, with
+//
+//	NewConn(c, isServer, 0, 0, nil, bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), c)), nil)
+//
+// The read loop must have stopped with an error while waiting for the next
+// message (for example after setting a read deadline in the past) and no
+// write may be in progress. The Conn must not be used after Detach returns.
+func (c *Conn) Detach() (conn net.Conn, buffered []byte, err error) {
+	if c.readErr == nil || c.readBoundary == false || c.isWriting {
+		return nil, nil, ErrNotAtBoundary
+	}
+	buffered, _ = c.br.Peek(c.br.Buffered())
+	buffered = append([]byte(nil), buffered...)
+	return c.conn, buffered, nil
+}
+
 // FormatCloseMessage formats closeCode and text as a WebSocket close message.
 // An empty message is returned for code CloseNoStatusReceived.
 func FormatCloseMessage(closeCode int, text string) []byte {
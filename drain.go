@@ -0,0 +1,203 @@
+package bee
+
+import (
+	"context"
+	"github.com/smartwalle/bee/conn"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	kDefaultDrainDuration   = 30 * time.Second
+	kDefaultDrainBatches    = 10
+	kDefaultReconnectDelay  = time.Second
+	kDefaultReconnectJitter = 10 * time.Second
+
+	kReconnectDelayPrefix = "retry-after="
+)
+
+// --------------------------------------------------------------------------------
+type DrainOption interface {
+	Apply(*drainer)
+}
+
+type drainOptionFunc func(*drainer)
+
+func (f drainOptionFunc) Apply(d *drainer) {
+	f(d)
+}
+
+// WithDrainDuration 设置关闭所有 Session 所用的时间，默认为 30 秒。
+func WithDrainDuration(duration time.Duration) DrainOption {
+	return drainOptionFunc(func(d *drainer) {
+		if duration < 0 {
+			duration = 0
+		}
+		d.duration = duration
+	})
+}
+
+// WithDrainBatches 设置 Session 被分成多少批关闭，每一批之间的间隔为 duration / batches，默认为 10 批。
+func WithDrainBatches(batches int) DrainOption {
+	return drainOptionFunc(func(d *drainer) {
+		if batches <= 0 {
+			batches = kDefaultDrainBatches
+		}
+		d.batches = batches
+	})
+}
+
+// WithReconnectDelay 设置建议客户端重连的延迟，每个 Session 的延迟为 delay 加上 [0, jitter) 之间的随机值，避免客户端同时重连。
+func WithReconnectDelay(delay, jitter time.Duration) DrainOption {
+	return drainOptionFunc(func(d *drainer) {
+		if delay < 0 {
+			delay = 0
+		}
+		if jitter < 0 {
+			jitter = 0
+		}
+		d.delay = delay
+		d.jitter = jitter
+	})
+}
+
+// WithDrainProgress 设置进度回调，每关闭一批 Session 之后调用。
+func WithDrainProgress(f func(p DrainProgress)) DrainOption {
+	return drainOptionFunc(func(d *drainer) {
+		d.progress = f
+	})
+}
+
+// --------------------------------------------------------------------------------
+type DrainProgress struct {
+	Total   int
+	Closed  int
+	Batch   int
+	Batches int
+	Elapsed time.Duration
+}
+
+type drainer struct {
+	duration time.Duration
+	batches  int
+	delay    time.Duration
+	jitter   time.Duration
+	progress func(p DrainProgress)
+}
+
+// Drain 用于滚动发布时平滑地关闭服务：首先停止 listeners 接受新的连接，然后在 duration 内将 hub 中的 Session 分批关闭，
+// 关闭时使用 CloseGoingAway，并且在 reason 中携带建议的重连延迟，客户端可以通过 ReconnectDelay 获取。
+//
+// listeners 实现了 StopAccept 方法时（比如 QUICListener）调用 StopAccept，否则调用 Close。
+// 使用集群时 hub 需要为本节点的 Hub（cluster.Hub 的 Local）。
+// ctx 被取消时停止关闭剩余的 Session 并返回 ctx.Err()。
+func Drain(ctx context.Context, hub Hub, listeners []io.Closer, opts ...DrainOption) (DrainProgress, error) {
+	var d = &drainer{}
+	d.duration = kDefaultDrainDuration
+	d.batches = kDefaultDrainBatches
+	d.delay = kDefaultReconnectDelay
+	d.jitter = kDefaultReconnectJitter
+
+	for _, opt := range opts {
+		opt.Apply(d)
+	}
+
+	for _, ln := range listeners {
+		if sa, ok := ln.(interface{ StopAccept() }); ok {
+			sa.StopAccept()
+		} else {
+			ln.Close()
+		}
+	}
+
+	var start = time.Now()
+	var interval = d.duration / time.Duration(d.batches)
+	var p = DrainProgress{Batches: d.batches}
+
+	// 每一批关闭之前重新获取 Session，关闭期间新建立的 Session（比如通过已有的 QUIC 连接）也会被关闭
+	var closed = make(map[Session]struct{})
+	for p.Batch < d.batches {
+		if p.Batch > 0 {
+			var timer = time.NewTimer(start.Add(interval * time.Duration(p.Batch)).Sub(time.Now()))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return p, ctx.Err()
+			}
+		}
+
+		var remain = d.remain(hub, closed)
+		var left = d.batches - p.Batch
+		var size = (len(remain) + left - 1) / left
+		for _, s := range remain[:size] {
+			d.close(s, closed)
+		}
+		p.Total = p.Closed + len(remain)
+		p.Closed += size
+		p.Batch++
+		p.Elapsed = time.Since(start)
+
+		if d.progress != nil {
+			d.progress(p)
+		}
+		if p.Closed >= p.Total {
+			break
+		}
+	}
+
+	// 最后一批之后仍然可能有新的 Session，再检查一次
+	var remain = d.remain(hub, closed)
+	for _, s := range remain {
+		d.close(s, closed)
+	}
+	p.Total += len(remain)
+	p.Closed += len(remain)
+	p.Elapsed = time.Since(start)
+	return p, nil
+}
+
+// remain 返回 hub 中还没有被关闭的 Session。
+func (this *drainer) remain(hub Hub, closed map[Session]struct{}) []Session {
+	var sessions = hub.GetAllSessions()
+	var remain = make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		if _, ok := closed[s]; ok == false {
+			remain = append(remain, s)
+		}
+	}
+	return remain
+}
+
+func (this *drainer) close(s Session, closed map[Session]struct{}) {
+	s.CloseWithCode(CloseGoingAway, FormatReconnectDelay(this.reconnectDelay()))
+	closed[s] = struct{}{}
+}
+
+func (this *drainer) reconnectDelay() time.Duration {
+	var delay = this.delay
+	if this.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(this.jitter)))
+	}
+	return delay
+}
+
+// FormatReconnectDelay 返回携带重连延迟的 close reason。
+func FormatReconnectDelay(delay time.Duration) string {
+	return kReconnectDelayPrefix + delay.Round(time.Millisecond).String()
+}
+
+// ReconnectDelay 从 Session 关闭时的错误中获取服务端建议的重连延迟，ok 为 false 表示服务端没有建议。
+func ReconnectDelay(err error) (delay time.Duration, ok bool) {
+	ce, ok := err.(*conn.CloseError)
+	if ok == false || strings.HasPrefix(ce.Text, kReconnectDelayPrefix) == false {
+		return 0, false
+	}
+	delay, e := time.ParseDuration(strings.TrimPrefix(ce.Text, kReconnectDelayPrefix))
+	if e != nil {
+		return 0, false
+	}
+	return delay, true
+}
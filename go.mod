@@ -1,8 +1,14 @@
 module github.com/smartwalle/bee
 
-go 1.12
+go 1.24
 
 require (
-	github.com/gorilla/websocket v1.4.0 // indirect
-	github.com/lucas-clemente/quic-go v0.12.0
+	github.com/gorilla/websocket v1.4.0
+	github.com/quic-go/quic-go v0.59.1
+)
+
+require (
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 )
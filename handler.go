@@ -10,3 +10,8 @@ type Handler interface {
 
 	DidReceivedData(s Session, data []byte)
 }
+
+// DatagramHandler 为可选接口，Handler 实现了该接口并且连接支持不可靠数据报时，通过该接口接收数据报。
+type DatagramHandler interface {
+	DidReceivedDatagram(s Session, data []byte)
+}
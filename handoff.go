@@ -0,0 +1,502 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package bee
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	kHandoffListener = 1
+	kHandoffSession  = 2
+	kHandoffEnd      = 3
+
+	kMaxHandoffRecordSize = 64 << 20
+)
+
+var (
+	ErrHandoffNotSupported = errors.New("handoff is not supported")
+	ErrHandedOff           = errors.New("session has been handed off")
+)
+
+// --------------------------------------------------------------------------------
+// SessionState 为移交给其它进程的 Session 的状态。
+// Attributes 使用 encoding/gob 编码，自定义类型需要在两个进程中通过 gob.Register 注册，无法编码的 Session 不会被移交。
+type SessionState struct {
+	Identifier string
+	Tag        string
+	IsServer   bool
+	// Buffered 为已经从连接中读取但是尚未处理的数据
+	Buffered   []byte
+	Attributes map[string]interface{}
+	Queued     []QueuedMessage
+}
+
+type QueuedMessage struct {
+	Data     []byte
+	Priority Priority
+	Key      string
+	Expires  time.Time
+}
+
+type handoffRecord struct {
+	Kind  int
+	Name  string
+	State *SessionState
+}
+
+// --------------------------------------------------------------------------------
+type HandoffResult struct {
+	Listeners int
+	Sessions  int
+	// Skipped 为无法移交的 Session（比如 TLS、QUIC 连接），它们仍然由当前进程处理，可以通过 Drain 关闭
+	Skipped []Session
+}
+
+// Handoff 用于不断开连接的进程升级：将 listeners 及 sessions 的 socket 和状态通过 Unix socket path 移交给新的进程，
+// 新的进程需要先调用 ReceiveHandoff 监听 path。
+//
+// 移交成功之后当前进程关闭 listeners（socket 仍然由新进程持有），已移交的 Session 以 ErrHandedOff 关闭，
+// Handler 的 DidClosedSession 会被调用，但是连接不会断开，也不会向对端发送关闭消息；
+// 移交失败时所有的 Session 恢复正常，listeners 不受影响。
+//
+// 只支持基于 TCP 或者 Unix socket 并且没有使用 TLS 的连接，移交期间写入 Session 的消息将被丢弃。
+func Handoff(ctx context.Context, path string, listeners map[string]io.Closer, sessions []Session) (result *HandoffResult, err error) {
+	var files = make(map[string]*os.File, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for name, ln := range listeners {
+		f, err := listenerFile(ln)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = f
+	}
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var uc = c.(*net.UnixConn)
+	var stop = watchContext(ctx, uc)
+	defer stop()
+
+	for name, f := range files {
+		if err = writeHandoffRecord(uc, &handoffRecord{Kind: kHandoffListener, Name: name}, f); err != nil {
+			return nil, err
+		}
+	}
+
+	result = &HandoffResult{Listeners: len(files)}
+	var exported []*session
+	defer func() {
+		// 移交失败，恢复所有已经导出的 Session
+		if err != nil {
+			for _, s := range exported {
+				s.finishExport(err)
+			}
+		}
+	}()
+
+	for _, s := range sessions {
+		ss, ok := s.(*session)
+		if ok == false {
+			result.Skipped = append(result.Skipped, s)
+			continue
+		}
+
+		f, state, eErr := ss.export()
+		if eErr != nil {
+			if eErr == ErrHandoffNotSupported {
+				result.Skipped = append(result.Skipped, s)
+			}
+			continue
+		}
+		exported = append(exported, ss)
+
+		err = writeHandoffRecord(uc, &handoffRecord{Kind: kHandoffSession, State: state}, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = writeHandoffRecord(uc, &handoffRecord{Kind: kHandoffEnd}, nil); err != nil {
+		return nil, err
+	}
+
+	// 等待新进程确认已经接收了所有的 socket
+	ack, fd, err := readHandoffRecord(uc)
+	if fd >= 0 {
+		syscall.Close(fd)
+	}
+	if err == nil && ack.Kind != kHandoffEnd {
+		err = errors.New("handoff: unexpected record")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, s := range exported {
+		s.finishExport(nil)
+	}
+	result.Sessions = len(exported)
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------
+// HandoffState 为新进程从旧进程接收到的监听及 Session。
+type HandoffState struct {
+	Listeners map[string]net.Listener
+	Sessions  []*HandedSession
+}
+
+type HandedSession struct {
+	State *SessionState
+	conn  net.Conn
+}
+
+// NewSession 使用接收到的连接及状态重建 Session，Session 直接打开，不会再进行认证或者会话恢复的握手。
+func (this *HandedSession) NewSession(handler Handler, opts ...Option) Session {
+	var st = this.State
+	var c = NewConn(this.conn, st.IsServer, 0, 0, nil, bufio.NewReader(io.MultiReader(bytes.NewReader(st.Buffered), this.conn)), nil)
+
+	var s = newSession(c, handler, opts...)
+	s.identifier = st.Identifier
+	s.tag = st.Tag
+	for key, value := range st.Attributes {
+		s.data[key] = value
+	}
+	for _, qm := range st.Queued {
+		s.outbox.push(&message{data: qm.Data, priority: qm.Priority, key: qm.Key, expires: qm.Expires})
+	}
+	s.run(false)
+	return s
+}
+
+// ReceiveHandoff 监听 Unix socket path，等待旧进程调用 Handoff 移交监听及 Session。
+// 接收到的监听可以直接使用，比如 &bee.Listener{Listener: ln} 或者 bee.NewTLSListener(ln, config)。
+func ReceiveHandoff(ctx context.Context, path string) (*HandoffState, error) {
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	var stop = watchContext(ctx, ln)
+	uc, err := ln.AcceptUnix()
+	stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	defer uc.Close()
+	stop = watchContext(ctx, uc)
+	defer stop()
+
+	var state = &HandoffState{Listeners: make(map[string]net.Listener)}
+	for {
+		r, fd, err := readHandoffRecord(uc)
+		if err != nil {
+			if fd >= 0 {
+				syscall.Close(fd)
+			}
+			state.close()
+			return nil, err
+		}
+		if r.Kind == kHandoffEnd {
+			break
+		}
+		if fd < 0 {
+			state.close()
+			return nil, errors.New("handoff: missing file descriptor")
+		}
+
+		var f = os.NewFile(uintptr(fd), r.Name)
+		switch r.Kind {
+		case kHandoffListener:
+			var l net.Listener
+			if l, err = net.FileListener(f); err == nil {
+				state.Listeners[r.Name] = l
+			}
+		case kHandoffSession:
+			var c net.Conn
+			if c, err = net.FileConn(f); err == nil {
+				state.Sessions = append(state.Sessions, &HandedSession{State: r.State, conn: c})
+			}
+		default:
+			err = errors.New("handoff: unexpected record")
+		}
+		f.Close()
+
+		if err != nil {
+			state.close()
+			return nil, err
+		}
+	}
+
+	if err = writeHandoffRecord(uc, &handoffRecord{Kind: kHandoffEnd}, nil); err != nil {
+		state.close()
+		return nil, err
+	}
+	return state, nil
+}
+
+func (this *HandoffState) close() {
+	for _, l := range this.Listeners {
+		l.Close()
+	}
+	for _, s := range this.Sessions {
+		s.conn.Close()
+	}
+}
+
+// --------------------------------------------------------------------------------
+// export 停止 Session 的 read/write goroutine，返回连接的文件描述符以及 Session 的状态，
+// 之后需要调用 finishExport 结束移交或者恢复 Session。
+func (this *session) export() (f *os.File, state *SessionState, err error) {
+	this.mu.Lock()
+	if this.isClosed || this.isOpened == false || (this.resume != nil && this.resume.detached) {
+		this.mu.Unlock()
+		return nil, nil, ErrHandoffNotSupported
+	}
+	dc, ok := this.conn.(detacher)
+	if ok == false || fileConn(dc.UnderlyingConn()) == nil {
+		this.mu.Unlock()
+		return nil, nil, ErrHandoffNotSupported
+	}
+
+	// 使 read goroutine 在读取下一条消息时超时退出
+	this.gen++
+	close(this.stop)
+	this.conn.SetReadDeadline(time.Now())
+	var done = this.readDone
+	this.mu.Unlock()
+
+	<-done
+
+	this.mu.Lock()
+	if this.isClosed {
+		this.mu.Unlock()
+		return nil, nil, errSessionClosed
+	}
+
+	nc, buffered, err := dc.Detach()
+	if err == nil {
+		f, err = fileConn(nc).File()
+	}
+	if err != nil {
+		this.mu.Unlock()
+		// 连接已经无法继续使用，关闭 Session，客户端重连之后由新的进程处理
+		this.CloseWithCode(CloseGoingAway, "")
+		return nil, nil, err
+	}
+
+	state = &SessionState{Identifier: this.identifier, Tag: this.tag, IsServer: dc.IsServer(), Buffered: buffered}
+	this.dataMu.RLock()
+	state.Attributes = make(map[string]interface{}, len(this.data))
+	for key, value := range this.data {
+		state.Attributes[key] = value
+	}
+	this.dataMu.RUnlock()
+
+	this.exported = this.outbox.takeAll()
+	for _, m := range this.exported {
+		state.Queued = append(state.Queued, QueuedMessage{Data: m.data, Priority: m.priority, Key: m.key, Expires: m.expires})
+	}
+	this.exportedConn = nc
+	this.exportedBuffer = buffered
+	this.mu.Unlock()
+
+	// 提前检查状态能否被编码，避免移交过程中失败
+	if err = gob.NewEncoder(ioutil.Discard).Encode(state); err != nil {
+		f.Close()
+		this.finishExport(err)
+		return nil, nil, err
+	}
+	return f, state, nil
+}
+
+// finishExport 在移交结束之后调用，err 为 nil 表示移交成功，关闭 Session；否则使用原来的连接恢复 Session。
+func (this *session) finishExport(err error) {
+	this.mu.Lock()
+	var nc = this.exportedConn
+	var buffered = this.exportedBuffer
+	var exported = this.exported
+	this.exportedConn = nil
+	this.exportedBuffer = nil
+	this.exported = nil
+
+	if nc == nil || this.isClosed {
+		this.mu.Unlock()
+		return
+	}
+
+	if err == nil {
+		this.mu.Unlock()
+		this.close(ErrHandedOff)
+		return
+	}
+
+	var isServer = this.conn.(detacher).IsServer()
+	this.conn = NewConn(nc, isServer, 0, 0, nil, bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), nc)), nil)
+	for i := len(exported) - 1; i >= 0; i-- {
+		this.outbox.requeue(exported[i])
+	}
+	this.start()
+	this.mu.Unlock()
+}
+
+type detacher interface {
+	Detach() (net.Conn, []byte, error)
+
+	IsServer() bool
+
+	UnderlyingConn() net.Conn
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+func fileConn(c net.Conn) filer {
+	if lc, ok := c.(*limitConn); ok {
+		c = lc.Conn
+	}
+	if f, ok := c.(filer); ok {
+		return f
+	}
+	return nil
+}
+
+func listenerFile(ln io.Closer) (*os.File, error) {
+	var l interface{} = ln
+	switch t := ln.(type) {
+	case *Listener:
+		l = t.Listener
+	case *TCPListener:
+		l = t.TCPListener
+	case *TLSListener:
+		l = t.ln
+	}
+	if f, ok := l.(filer); ok {
+		return f.File()
+	}
+	return nil, ErrHandoffNotSupported
+}
+
+// --------------------------------------------------------------------------------
+// 每条记录的格式为：长度(4 字节) + gob 编码的 handoffRecord，文件描述符通过 SCM_RIGHTS 随记录一起发送。
+func writeHandoffRecord(uc *net.UnixConn, r *handoffRecord, f *os.File) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return err
+	}
+	var b = buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+	n, _, err := uc.WriteMsgUnix(b, oob, nil)
+	if err == nil && n < len(b) {
+		_, err = uc.Write(b[n:])
+	}
+	return err
+}
+
+// readHandoffRecord 读取一条记录，fd 为随记录一起接收到的文件描述符，没有时为 -1。
+func readHandoffRecord(uc *net.UnixConn) (r *handoffRecord, fd int, err error) {
+	fd = -1
+	var head [4]byte
+	var oob = make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(head[:], oob)
+	if err != nil {
+		return nil, fd, err
+	}
+
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, fd, err
+		}
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				continue
+			}
+			for _, v := range fds {
+				if fd < 0 {
+					fd = v
+				} else {
+					syscall.Close(v)
+				}
+			}
+		}
+	}
+
+	if n < len(head) {
+		if _, err = io.ReadFull(uc, head[n:]); err != nil {
+			return nil, fd, err
+		}
+	}
+
+	var size = binary.BigEndian.Uint32(head[:])
+	if size > kMaxHandoffRecordSize {
+		return nil, fd, errors.New("handoff: record too large")
+	}
+	var b = make([]byte, size)
+	if _, err = io.ReadFull(uc, b); err != nil {
+		return nil, fd, err
+	}
+
+	r = &handoffRecord{}
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(r); err != nil {
+		return nil, fd, err
+	}
+	return r, fd, nil
+}
+
+// watchContext 在 ctx 被取消时关闭 c，返回的 stop 用于停止监听。
+func watchContext(ctx context.Context, c io.Closer) (stop func()) {
+	var done = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	}
+}
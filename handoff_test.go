@@ -0,0 +1,204 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package bee
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	kHandoffPathEnv = "BEE_HANDOFF_PATH"
+	kHandoffTimeout = 5 * time.Second
+)
+
+// handoffHandler 回复收到的消息，回复中包含处理消息的进程、Session 的 identifier 以及属性 k。
+type handoffHandler struct {
+	process string
+	hub     Hub
+	hold    chan struct{}
+	closed  chan error
+}
+
+func (this *handoffHandler) DidOpenSession(s Session) {
+	if this.hub != nil {
+		this.hub.AddSession(s)
+	}
+}
+
+func (this *handoffHandler) DidClosedSession(s Session, err error) {
+	if this.hub != nil {
+		this.hub.RemoveSession(s)
+	}
+	this.closed <- err
+}
+
+func (this *handoffHandler) DidWrittenData(s Session, data []byte) {
+	// 阻塞 write goroutine，之后写入的消息会保留在发送队列中
+	if string(data) == "hold" {
+		<-this.hold
+	}
+}
+
+func (this *handoffHandler) DidReceivedData(s Session, data []byte) {
+	if data == nil {
+		return
+	}
+	if string(data) == "hold" {
+		s.WriteMessage([]byte("hold"))
+		s.WriteMessage([]byte("queued-1"))
+		s.WriteMessage([]byte("queued-2"))
+		return
+	}
+	var k, _ = s.Get("k").(string)
+	s.WriteMessage([]byte(fmt.Sprintf("%s:%s:%s:%s", this.process, data, s.Identifier(), k)))
+}
+
+// TestHandoffChild 为新进程，由 TestHandoff 启动。
+func TestHandoffChild(t *testing.T) {
+	var path = os.Getenv(kHandoffPathEnv)
+	if path == "" {
+		t.Skip("started by TestHandoff")
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), kHandoffTimeout)
+	defer cancel()
+
+	state, err := ReceiveHandoff(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ln := range state.Listeners {
+		defer ln.Close()
+	}
+	if len(state.Sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(state.Sessions))
+	}
+
+	var h = &handoffHandler{process: "new", closed: make(chan error, 1)}
+	state.Sessions[0].NewSession(h)
+
+	// 客户端断开之后退出
+	select {
+	case <-h.closed:
+	case <-ctx.Done():
+		t.Fatal("timeout waiting for client to disconnect")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "handoff.sock")
+
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hub = NewHub()
+	var h = &handoffHandler{process: "old", hub: hub, hold: make(chan struct{}), closed: make(chan error, 1)}
+	defer close(h.hold)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		var s = NewSession(c, h, WithIdentifier("u1"))
+		s.Set("k", "v")
+	}()
+
+	// 客户端直接写入 WebSocket 数据帧，以便在移交之前只发送数据帧的一部分
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var client = NewConn(raw, false, 0, 0, nil, nil, nil)
+
+	var expect = func(want string) {
+		t.Helper()
+		raw.SetReadDeadline(time.Now().Add(kHandoffTimeout))
+		_, got, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("expected %q: %v", want, err)
+		}
+		if string(got) != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	raw.Write(clientFrame("a"))
+	expect("old:a:u1:v")
+
+	raw.Write(clientFrame("hold"))
+	expect("hold")
+
+	var frame = clientFrame("b")
+	raw.Write(frame[:1])
+
+	var cmd = exec.Command(os.Args[0], "-test.run=^TestHandoffChild$")
+	cmd.Env = append(os.Environ(), kHandoffPathEnv+"="+path)
+	// 只在测试失败时输出新进程的日志
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var exited = false
+	defer func() {
+		if exited == false {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		if t.Failed() {
+			t.Logf("child process output:\n%s", output.String())
+		}
+	}()
+
+	var result *HandoffResult
+	var deadline = time.Now().Add(kHandoffTimeout)
+	for {
+		// 等待新进程开始监听 path
+		result, err = Handoff(context.Background(), path, map[string]io.Closer{"main": ln}, hub.GetAllSessions())
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Listeners != 1 || result.Sessions != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if err = <-h.closed; err != ErrHandedOff {
+		t.Fatalf("expected ErrHandedOff, got %v", err)
+	}
+
+	// 发送队列中的消息以及已经读取的部分数据帧由新进程继续处理
+	raw.Write(frame[1:])
+	expect("queued-1")
+	expect("queued-2")
+	expect("new:b:u1:v")
+
+	raw.Close()
+	exited = true
+	if err = cmd.Wait(); err != nil {
+		t.Fatalf("child process: %v", err)
+	}
+}
+
+// clientFrame 返回客户端发送的数据帧，掩码为 0，数据不需要变换。
+func clientFrame(data string) []byte {
+	var b = []byte{0x81, 0x80 | byte(len(data)), 0, 0, 0, 0}
+	return append(b, data...)
+}
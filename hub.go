@@ -1,132 +1,557 @@
 package bee
 
 import (
+	"errors"
 	"sync"
 	"sync/atomic"
 )
 
+var (
+	ErrSessionExists             = errors.New("session already exists")
+	ErrTooManySessions           = errors.New("too many sessions")
+	ErrTooManyIdentifierSessions = errors.New("too many sessions for identifier")
+)
+
+// DuplicatePolicy 用于处理 identifier 及 tag 都相同的 Session。
+type DuplicatePolicy int
+
+const (
+	// DuplicateIgnoreNew 保留已有的 Session，忽略新的 Session（不会关闭新的 Session），TryAddSession 返回 ErrSessionExists，为默认策略。
+	DuplicateIgnoreNew DuplicatePolicy = iota
+
+	// DuplicateKickOld 使用 CloseCode 关闭已有的 Session，并添加新的 Session。
+	DuplicateKickOld
+
+	// DuplicateRejectNew 保留已有的 Session，使用 CloseCode 关闭新的 Session，TryAddSession 返回 ErrSessionExists。
+	DuplicateRejectNew
+
+	// DuplicateAllowMultiple 同时保留所有的 Session，GetSession 返回最后添加的 Session。
+	DuplicateAllowMultiple
+)
+
+const (
+	kDefaultDuplicateCloseCode   = ClosePolicyViolation
+	kDefaultDuplicateCloseReason = "duplicate session"
+
+	kDefaultLimitCloseCode = CloseTryAgainLater
+)
+
 // --------------------------------------------------------------------------------
 type Hub interface {
 	AddSession(s Session)
 
+	// TryAddSession 和 AddSession 相同，Session 没有被添加时返回原因，如 ErrSessionExists 及 ErrTooManySessions。
+	TryAddSession(s Session) error
+
 	GetSession(identifier, tag string) Session
 
 	GetSessions(identifier string) []Session
 
 	GetAllSessions() []Session
 
+	// Range 遍历所有的 Session，f 返回 false 时停止遍历。
+	// 遍历期间不会持有 Hub 的锁，可以在 f 中调用 Hub 的其它方法。
+	Range(f func(s Session) bool)
+
 	RemoveSession(s Session)
 
 	RemoveSessions(identifier string)
 
 	Len() int64
+
+	Stats() HubStats
+
+	// Find 返回 f 返回 true 的 Session。
+	Find(f func(s Session) bool) []Session
+
+	// FindBy 返回属性 key 的值等于 value 的 Session，key 通过 WithIndexedAttributes 建立了索引时直接从索引中查找。
+	FindBy(key string, value interface{}) []Session
+
+	// AddObserver 添加观察者，观察者独立于 Handler，用于在不修改 Handler 的情况下监听 Hub 中 Session 的变化。
+	AddObserver(o HubObserver)
+
+	RemoveObserver(o HubObserver)
+}
+
+// HubObserver 的方法在 Hub 的锁之外调用，可以在其中调用 Hub 的方法。
+type HubObserver interface {
+	DidAddSession(h Hub, s Session)
+
+	// DidRemoveSession 在 Session 通过 RemoveSession 或者 RemoveSessions 从 Hub 中移除之后调用
+	DidRemoveSession(h Hub, s Session)
+
+	// DidReplaceSession 在 DuplicateKickOld 策略下 old 被 current 替换之后调用，old 不会再触发 DidRemoveSession
+	DidReplaceSession(h Hub, old, current Session)
+
+	// DidEmpty 在 Hub 中最后一个 Session 被移除之后调用
+	DidEmpty(h Hub)
+}
+
+// HubObserverFuncs 使用函数实现 HubObserver，未设置的函数将被忽略。
+type HubObserverFuncs struct {
+	Add     func(h Hub, s Session)
+	Remove  func(h Hub, s Session)
+	Replace func(h Hub, old, current Session)
+	Empty   func(h Hub)
+}
+
+func (this *HubObserverFuncs) DidAddSession(h Hub, s Session) {
+	if this.Add != nil {
+		this.Add(h, s)
+	}
+}
+
+func (this *HubObserverFuncs) DidRemoveSession(h Hub, s Session) {
+	if this.Remove != nil {
+		this.Remove(h, s)
+	}
+}
+
+func (this *HubObserverFuncs) DidReplaceSession(h Hub, old, current Session) {
+	if this.Replace != nil {
+		this.Replace(h, old, current)
+	}
+}
+
+func (this *HubObserverFuncs) DidEmpty(h Hub) {
+	if this.Empty != nil {
+		this.Empty(h)
+	}
+}
+
+type HubStats struct {
+	Sessions int64
+
+	// Displaced 因为重复而被关闭的 Session 数量
+	Displaced int64
+
+	// RejectedByLimit 因为超出 WithMaxSessions 限制而被拒绝的 Session 数量
+	RejectedByLimit int64
+
+	// RejectedByIdentifierLimit 因为超出 WithMaxSessionsPerIdentifier 限制而被拒绝的 Session 数量
+	RejectedByIdentifierLimit int64
 }
 
 // --------------------------------------------------------------------------------
-type hub struct {
+type HubOption interface {
+	Apply(*hub)
+}
+
+type hubOptionFunc func(*hub)
+
+func (f hubOptionFunc) Apply(h *hub) {
+	f(h)
+}
+
+func WithDuplicatePolicy(policy DuplicatePolicy) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		h.policy = policy
+	})
+}
+
+// WithDuplicateCloseCode 设置因为重复而被关闭的 Session 所使用的 close code 及 reason。
+func WithDuplicateCloseCode(code int, reason string) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		h.closeCode = code
+		h.closeReason = reason
+	})
+}
+
+// WithDisplacedHandler 设置 Session 因为重复而被关闭时的回调，displaced 为被关闭的 Session，current 为保留下来的 Session。
+func WithDisplacedHandler(f func(displaced, current Session)) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		h.displaced = f
+	})
+}
+
+// WithMaxSessions 设置 Hub 中 Session 的最大数量，超出时新的 Session 将被关闭，AddSession 返回 ErrTooManySessions。
+func WithMaxSessions(n int64) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		h.maxSessions = n
+	})
+}
+
+// WithMaxSessionsPerIdentifier 设置同一个 identifier 的 Session 的最大数量，超出时新的 Session 将被关闭，AddSession 返回 ErrTooManyIdentifierSessions。
+func WithMaxSessionsPerIdentifier(n int) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		h.maxPerIdentifier = n
+	})
+}
+
+// WithLimitCloseCode 设置因为超出数量限制而被关闭的 Session 所使用的 close code 及 reason，默认为 CloseTryAgainLater。
+func WithLimitCloseCode(code int, reason string) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		h.limitCode = code
+		h.limitReason = reason
+	})
+}
+
+// --------------------------------------------------------------------------------
+type hubShard struct {
 	mu sync.RWMutex
-	m  map[string]map[string]Session
-	c  int64
+	m  map[string][]Session
+}
+
+type hub struct {
+	shards []*hubShard
+	c      int64
+
+	policy      DuplicatePolicy
+	closeCode   int
+	closeReason string
+	displaced   func(displaced, current Session)
+
+	maxSessions      int64
+	maxPerIdentifier int
+	limitCode        int
+	limitReason      string
+
+	displacedCount       int64
+	rejectedByLimit      int64
+	rejectedByIdentifier int64
+
+	omu       sync.RWMutex
+	observers []HubObserver
+
+	index *attrIndex
 }
 
-func NewHub() Hub {
+var sessionsPool = sync.Pool{
+	New: func() interface{} {
+		var sl = make([]Session, 0, 64)
+		return &sl
+	},
+}
+
+func NewHub(opts ...HubOption) Hub {
+	return newHub(1, opts...)
+}
+
+// NewShardedHub 创建按照 identifier 分片的 Hub，每个分片使用独立的锁，适用于 Session 数量较多的场景。
+func NewShardedHub(shards int, opts ...HubOption) Hub {
+	if shards <= 0 {
+		shards = 1
+	}
+	return newHub(shards, opts...)
+}
+
+func newHub(shards int, opts ...HubOption) *hub {
 	var h = &hub{}
-	h.m = make(map[string]map[string]Session)
+	h.shards = make([]*hubShard, shards)
+	for i := range h.shards {
+		h.shards[i] = &hubShard{m: make(map[string][]Session)}
+	}
+	h.policy = DuplicateIgnoreNew
+	h.closeCode = kDefaultDuplicateCloseCode
+	h.closeReason = kDefaultDuplicateCloseReason
+	h.limitCode = kDefaultLimitCloseCode
+
+	for _, opt := range opts {
+		opt.Apply(h)
+	}
 	return h
 }
 
+func (this *hub) shard(identifier string) *hubShard {
+	if len(this.shards) == 1 {
+		return this.shards[0]
+	}
+	// FNV-1a
+	var h uint32 = 2166136261
+	for i := 0; i < len(identifier); i++ {
+		h ^= uint32(identifier[i])
+		h *= 16777619
+	}
+	return this.shards[h%uint32(len(this.shards))]
+}
+
 func (this *hub) AddSession(s Session) {
-	if s != nil {
-		this.mu.Lock()
-		defer this.mu.Unlock()
+	this.TryAddSession(s)
+}
+
+func (this *hub) TryAddSession(s Session) error {
+	if s == nil {
+		return nil
+	}
+
+	var shard = this.shard(s.Identifier())
+	shard.mu.Lock()
+
+	var sl = shard.m[s.Identifier()]
+	var old Session
+	for i, c := range sl {
+		if c == s {
+			shard.mu.Unlock()
+			return nil
+		}
+		if c.Tag() == s.Tag() {
+			old = c
+			if this.policy == DuplicateKickOld {
+				sl = append(sl[:i:i], sl[i+1:]...)
+			}
+			break
+		}
+	}
+
+	if old != nil && this.policy == DuplicateIgnoreNew {
+		shard.mu.Unlock()
+		return ErrSessionExists
+	}
+
+	if old != nil && this.policy == DuplicateRejectNew {
+		shard.mu.Unlock()
+		this.displace(s, old)
+		return ErrSessionExists
+	}
 
-		var sm = this.m[s.Identifier()]
+	var kick = old != nil && this.policy == DuplicateKickOld
 
-		if sm == nil {
-			sm = make(map[string]Session)
-			this.m[s.Identifier()] = sm
+	var err error
+	if this.maxPerIdentifier > 0 && len(sl) >= this.maxPerIdentifier {
+		atomic.AddInt64(&this.rejectedByIdentifier, 1)
+		err = ErrTooManyIdentifierSessions
+	} else if kick == false {
+		// 先占用计数再检查，避免多个分片同时添加时超出限制
+		if count := atomic.AddInt64(&this.c, 1); this.maxSessions > 0 && count > this.maxSessions {
+			atomic.AddInt64(&this.c, -1)
+			atomic.AddInt64(&this.rejectedByLimit, 1)
+			err = ErrTooManySessions
 		}
+	}
+	if err != nil {
+		shard.mu.Unlock()
 
-		if _, ok := sm[s.Tag()]; ok == false {
-			atomic.AddInt64(&this.c, 1)
-			sm[s.Tag()] = s
+		var reason = this.limitReason
+		if reason == "" {
+			reason = err.Error()
 		}
+		s.CloseWithCode(this.limitCode, reason)
+		return err
 	}
+
+	shard.m[s.Identifier()] = append(sl, s)
+	// 在持有分片锁时更新索引，避免并发的 RemoveSession 先于 add 执行而残留索引
+	if this.index != nil {
+		if kick {
+			this.index.remove(old)
+		}
+		this.index.add(s)
+	}
+	shard.mu.Unlock()
+
+	this.notify(func(o HubObserver) {
+		o.DidAddSession(this, s)
+	})
+	if kick {
+		this.notify(func(o HubObserver) {
+			o.DidReplaceSession(this, old, s)
+		})
+		this.displace(old, s)
+	}
+	return nil
+}
+
+func (this *hub) displace(displaced, current Session) {
+	atomic.AddInt64(&this.displacedCount, 1)
+	if this.displaced != nil {
+		this.displaced(displaced, current)
+	}
+	displaced.CloseWithCode(this.closeCode, this.closeReason)
 }
 
 func (this *hub) GetSession(identifier, tag string) Session {
-	this.mu.RLock()
-	defer this.mu.RUnlock()
+	var shard = this.shard(identifier)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if tag == "" {
+		tag = kDefaultTag
+	}
 
-	var sm = this.m[identifier]
-	if sm != nil {
-		if tag == "" {
-			tag = kDefaultTag
+	var sl = shard.m[identifier]
+	for i := len(sl) - 1; i >= 0; i-- {
+		if sl[i].Tag() == tag {
+			return sl[i]
 		}
-		var c = sm[tag]
-		return c
 	}
 	return nil
 }
 
 func (this *hub) GetSessions(identifier string) []Session {
-	this.mu.RLock()
-	defer this.mu.RUnlock()
-
-	var sm = this.m[identifier]
-	if sm != nil {
-		var sl = make([]Session, 0, len(sm))
-		for _, s := range sm {
-			sl = append(sl, s)
-		}
-		return sl
+	var shard = this.shard(identifier)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	var sl = shard.m[identifier]
+	if sl != nil {
+		var nl = make([]Session, len(sl))
+		copy(nl, sl)
+		return nl
 	}
 	return nil
 }
 
 func (this *hub) GetAllSessions() []Session {
-	this.mu.RLock()
-	defer this.mu.RUnlock()
+	var nl = make([]Session, 0, atomic.LoadInt64(&this.c))
+	for _, shard := range this.shards {
+		shard.mu.RLock()
+		for _, sl := range shard.m {
+			nl = append(nl, sl...)
+		}
+		shard.mu.RUnlock()
+	}
+	return nl
+}
 
-	var sl = make([]Session, 0, len(this.m))
-	for _, cm := range this.m {
-		for _, c := range cm {
-			sl = append(sl, c)
+func (this *hub) Range(f func(s Session) bool) {
+	var buf = sessionsPool.Get().(*[]Session)
+	defer sessionsPool.Put(buf)
+
+	for _, shard := range this.shards {
+		// 逐个分片复制到复用的缓冲区中，回调期间不持有锁
+		var sl = (*buf)[:0]
+		shard.mu.RLock()
+		for _, ssl := range shard.m {
+			sl = append(sl, ssl...)
+		}
+		shard.mu.RUnlock()
+
+		var next = true
+		for _, s := range sl {
+			if next = f(s); next == false {
+				break
+			}
+		}
+
+		for i := range sl {
+			sl[i] = nil
+		}
+		*buf = sl[:0]
+
+		if next == false {
+			return
 		}
 	}
-	return sl
 }
 
 func (this *hub) RemoveSession(s Session) {
-	if s != nil {
-		this.mu.Lock()
-		defer this.mu.Unlock()
-
-		var sm = this.m[s.Identifier()]
-		if sm != nil {
-			var c = sm[s.Tag()]
-			if c != nil {
-				delete(sm, c.Tag())
-				atomic.AddInt64(&this.c, -1)
-			}
-			if len(sm) == 0 {
-				delete(this.m, s.Identifier())
-			}
+	if s == nil {
+		return
+	}
+
+	var shard = this.shard(s.Identifier())
+	shard.mu.Lock()
+
+	var sl = shard.m[s.Identifier()]
+	var removed = false
+	var count int64
+	for i, c := range sl {
+		// 只移除 s 本身，避免移除已经替换了 s 的新 Session
+		if c == s {
+			sl = append(sl[:i:i], sl[i+1:]...)
+			count = atomic.AddInt64(&this.c, -1)
+			removed = true
+			break
+		}
+	}
+
+	if len(sl) == 0 {
+		delete(shard.m, s.Identifier())
+	} else {
+		shard.m[s.Identifier()] = sl
+	}
+	if removed && this.index != nil {
+		this.index.remove(s)
+	}
+	shard.mu.Unlock()
+
+	if removed {
+		this.notify(func(o HubObserver) {
+			o.DidRemoveSession(this, s)
+		})
+		if count == 0 {
+			this.notifyEmpty()
 		}
 	}
 }
 
 func (this *hub) RemoveSessions(identifier string) {
-	this.mu.Lock()
-	defer this.mu.Unlock()
+	var shard = this.shard(identifier)
+	shard.mu.Lock()
+
+	var sl = shard.m[identifier]
+	var count int64 = -1
+	if sl != nil {
+		delete(shard.m, identifier)
+		count = atomic.AddInt64(&this.c, -int64(len(sl)))
+	}
+	if this.index != nil {
+		for _, s := range sl {
+			this.index.remove(s)
+		}
+	}
+	shard.mu.Unlock()
 
-	var sm = this.m[identifier]
-	if sm != nil {
-		delete(this.m, identifier)
-		atomic.AddInt64(&this.c, -int64(len(sm)))
+	for _, s := range sl {
+		this.notify(func(o HubObserver) {
+			o.DidRemoveSession(this, s)
+		})
 	}
+	if count == 0 {
+		this.notifyEmpty()
+	}
+}
+
+func (this *hub) AddObserver(o HubObserver) {
+	if o == nil {
+		return
+	}
+	this.omu.Lock()
+	defer this.omu.Unlock()
+
+	var ol = make([]HubObserver, 0, len(this.observers)+1)
+	ol = append(ol, this.observers...)
+	this.observers = append(ol, o)
+}
+
+func (this *hub) RemoveObserver(o HubObserver) {
+	this.omu.Lock()
+	defer this.omu.Unlock()
+
+	var ol = make([]HubObserver, 0, len(this.observers))
+	for _, c := range this.observers {
+		if c != o {
+			ol = append(ol, c)
+		}
+	}
+	this.observers = ol
+}
+
+func (this *hub) notify(f func(o HubObserver)) {
+	this.omu.RLock()
+	var ol = this.observers
+	this.omu.RUnlock()
+
+	for _, o := range ol {
+		f(o)
+	}
+}
+
+func (this *hub) notifyEmpty() {
+	this.notify(func(o HubObserver) {
+		o.DidEmpty(this)
+	})
 }
 
 func (this *hub) Len() int64 {
 	return atomic.LoadInt64(&this.c)
 }
+
+func (this *hub) Stats() HubStats {
+	return HubStats{
+		Sessions:                  atomic.LoadInt64(&this.c),
+		Displaced:                 atomic.LoadInt64(&this.displacedCount),
+		RejectedByLimit:           atomic.LoadInt64(&this.rejectedByLimit),
+		RejectedByIdentifierLimit: atomic.LoadInt64(&this.rejectedByIdentifier),
+	}
+}
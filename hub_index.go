@@ -0,0 +1,202 @@
+package bee
+
+import (
+	"reflect"
+	"sync"
+)
+
+// WithIndexedAttributes 为 Session 中指定 key 的属性建立索引，FindBy 使用这些 key 进行查询时不需要遍历所有的 Session。
+// 通过 Session 的 Set 及 Del 修改属性时会同步更新索引，只有可比较（可以作为 map 的 key）的属性值会被索引。
+func WithIndexedAttributes(keys ...string) HubOption {
+	return hubOptionFunc(func(h *hub) {
+		if len(keys) == 0 {
+			return
+		}
+		if h.index == nil {
+			h.index = newAttrIndex()
+		}
+		for _, key := range keys {
+			h.index.keys[key] = struct{}{}
+		}
+	})
+}
+
+// Broadcast 向 sessions 发送消息，返回发送成功的数量，通常和 Hub 的 Find 及 FindBy 一起使用：
+//
+//	bee.Broadcast(h.FindBy("region", "eu"), data)
+func Broadcast(sessions []Session, data []byte) (n int) {
+	for _, s := range sessions {
+		if s.WriteMessage(data) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// --------------------------------------------------------------------------------
+type attributeWatchable interface {
+	watchAttributes(f func(s Session, key string, old, value interface{})) (cancel func())
+}
+
+type attrIndex struct {
+	mu      sync.RWMutex
+	keys    map[string]struct{}
+	m       map[string]map[interface{}]map[Session]struct{}
+	values  map[Session]map[string]interface{}
+	cancels map[Session]func()
+}
+
+func newAttrIndex() *attrIndex {
+	var idx = &attrIndex{}
+	idx.keys = make(map[string]struct{})
+	idx.m = make(map[string]map[interface{}]map[Session]struct{})
+	idx.values = make(map[Session]map[string]interface{})
+	idx.cancels = make(map[Session]func())
+	return idx
+}
+
+func (this *attrIndex) indexed(key string) bool {
+	_, ok := this.keys[key]
+	return ok
+}
+
+func (this *attrIndex) add(s Session) {
+	this.mu.Lock()
+	if _, ok := this.values[s]; ok {
+		this.mu.Unlock()
+		return
+	}
+	this.values[s] = make(map[string]interface{})
+	this.mu.Unlock()
+
+	// 先监听再读取属性，避免遗漏期间发生的修改
+	var cancel func()
+	if w, ok := s.(attributeWatchable); ok {
+		cancel = w.watchAttributes(func(s Session, key string, old, value interface{}) {
+			if this.indexed(key) {
+				this.refresh(s, key)
+			}
+		})
+	}
+
+	for key := range this.keys {
+		this.refresh(s, key)
+	}
+
+	this.mu.Lock()
+	if _, ok := this.values[s]; ok == false {
+		// 在添加期间已经被移除
+		this.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		return
+	}
+	if cancel != nil {
+		this.cancels[s] = cancel
+	}
+	this.mu.Unlock()
+}
+
+func (this *attrIndex) remove(s Session) {
+	this.mu.Lock()
+	for key, value := range this.values[s] {
+		this.unlink(s, key, value)
+	}
+	delete(this.values, s)
+	var cancel = this.cancels[s]
+	delete(this.cancels, s)
+	this.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// refresh 使用 Session 当前的属性值更新索引。
+// 并发修改同一个属性时，监听回调的执行顺序和修改的顺序可能不一致，所以在持有 mu 时重新读取属性值，而不是使用回调中的值。
+func (this *attrIndex) refresh(s Session, key string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var vm, ok = this.values[s]
+	if ok == false {
+		return
+	}
+	var value = s.Get(key)
+
+	if old, ok := vm[key]; ok {
+		this.unlink(s, key, old)
+		delete(vm, key)
+	}
+
+	if value == nil || reflect.TypeOf(value).Comparable() == false {
+		return
+	}
+
+	var km = this.m[key]
+	if km == nil {
+		km = make(map[interface{}]map[Session]struct{})
+		this.m[key] = km
+	}
+	var sm = km[value]
+	if sm == nil {
+		sm = make(map[Session]struct{})
+		km[value] = sm
+	}
+	sm[s] = struct{}{}
+	vm[key] = value
+}
+
+func (this *attrIndex) unlink(s Session, key string, value interface{}) {
+	var km = this.m[key]
+	var sm = km[value]
+	delete(sm, s)
+	if len(sm) == 0 {
+		delete(km, value)
+	}
+	if len(km) == 0 {
+		delete(this.m, key)
+	}
+}
+
+func (this *attrIndex) find(key string, value interface{}) []Session {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var sm = this.m[key][value]
+	var sl = make([]Session, 0, len(sm))
+	for s := range sm {
+		sl = append(sl, s)
+	}
+	return sl
+}
+
+// --------------------------------------------------------------------------------
+func (this *hub) Find(f func(s Session) bool) []Session {
+	var sl []Session
+	this.Range(func(s Session) bool {
+		if f(s) {
+			sl = append(sl, s)
+		}
+		return true
+	})
+	return sl
+}
+
+func (this *hub) FindBy(key string, value interface{}) []Session {
+	if value == nil || reflect.TypeOf(value).Comparable() == false {
+		return this.Find(func(s Session) bool {
+			return reflect.DeepEqual(s.Get(key), value)
+		})
+	}
+
+	if this.index != nil && this.index.indexed(key) {
+		return this.index.find(key, value)
+	}
+
+	return this.Find(func(s Session) bool {
+		var v = s.Get(key)
+		return v != nil && reflect.TypeOf(v).Comparable() && v == value
+	})
+}
@@ -0,0 +1,71 @@
+package bee
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/smartwalle/bee/conn"
+	"time"
+)
+
+var (
+	ErrNoClientCertificate = errors.New("no verified client certificate")
+)
+
+// CertIdentityFunc 根据已验证的客户端证书生成 Session 的 identifier 和 tag，tag 为空时使用默认的 tag。
+type CertIdentityFunc func(cert *x509.Certificate) (identifier, tag string, err error)
+
+// WithCertIdentity 使用客户端证书生成 Session 的 identifier 和 tag，会覆盖 WithIdentifier 和 WithTag 的设置。
+// 只适用于 TLS（ListenTLS）和 QUIC 连接，并且需要在 tls.Config 中设置 ClientAuth 为 tls.RequireAndVerifyClientCert。
+// 连接没有通过验证的客户端证书或者 f 返回错误时，将使用 ClosePolicyViolation 关闭连接，NewSession 返回 nil。
+func WithCertIdentity(f CertIdentityFunc) Option {
+	return optionFunc(func(s *session) {
+		s.certIdentity = f
+	})
+}
+
+// CertCommonName 使用证书 Subject 中的 CommonName 作为 identifier。
+func CertCommonName(cert *x509.Certificate) (identifier, tag string, err error) {
+	if cert.Subject.CommonName == "" {
+		return "", "", errors.New("certificate has no common name")
+	}
+	return cert.Subject.CommonName, "", nil
+}
+
+// CertURI 使用证书 SAN 中的第一个 URI 作为 identifier，比如 spiffe://example.org/device/1。
+func CertURI(cert *x509.Certificate) (identifier, tag string, err error) {
+	if len(cert.URIs) == 0 {
+		return "", "", errors.New("certificate has no uri")
+	}
+	return cert.URIs[0].String(), "", nil
+}
+
+func (this *session) resolveCertIdentity() error {
+	if this.certIdentity == nil {
+		return nil
+	}
+
+	state, ok := connectionState(this.conn)
+	if ok == false || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ErrNoClientCertificate
+	}
+
+	identifier, tag, err := this.certIdentity(state.PeerCertificates[0])
+	if err != nil {
+		return err
+	}
+	if identifier == "" {
+		return ErrNoClientCertificate
+	}
+	if tag == "" {
+		tag = kDefaultTag
+	}
+	this.identifier = identifier
+	this.tag = tag
+	return nil
+}
+
+func (this *session) reject(code int, err error) {
+	this.conn.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+	this.conn.WriteMessage(CloseMessage, conn.FormatCloseMessage(code, err.Error()))
+	this.conn.Close()
+}
@@ -0,0 +1,119 @@
+package bee
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// --------------------------------------------------------------------------------
+// IPLimiter 用于限制同一个 IP 同时建立的连接数量，在连接被 Accept 之后、握手之前进行检查，
+// 超出限制的连接将被直接关闭。
+//
+//	l, _ := bee.Listen("tcp", ":8080")
+//	l.Limiter = bee.NewIPLimiter(16)
+type IPLimiter struct {
+	mu       sync.Mutex
+	max      int
+	m        map[string]int
+	active   int64
+	rejected int64
+}
+
+type IPLimiterStats struct {
+	Active   int64
+	Rejected int64
+}
+
+func NewIPLimiter(max int) *IPLimiter {
+	var l = &IPLimiter{}
+	l.max = max
+	l.m = make(map[string]int)
+	return l
+}
+
+func (this *IPLimiter) Acquire(addr net.Addr) bool {
+	var ip = ipOf(addr)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.max > 0 && this.m[ip] >= this.max {
+		atomic.AddInt64(&this.rejected, 1)
+		return false
+	}
+	this.m[ip]++
+	atomic.AddInt64(&this.active, 1)
+	return true
+}
+
+func (this *IPLimiter) Release(addr net.Addr) {
+	var ip = ipOf(addr)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if n, ok := this.m[ip]; ok {
+		if n <= 1 {
+			delete(this.m, ip)
+		} else {
+			this.m[ip] = n - 1
+		}
+		atomic.AddInt64(&this.active, -1)
+	}
+}
+
+func (this *IPLimiter) Count(addr net.Addr) int {
+	var ip = ipOf(addr)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.m[ip]
+}
+
+func (this *IPLimiter) Stats() IPLimiterStats {
+	return IPLimiterStats{
+		Active:   atomic.LoadInt64(&this.active),
+		Rejected: atomic.LoadInt64(&this.rejected),
+	}
+}
+
+// limit 在 c 允许建立时返回包装之后的连接，连接关闭时释放计数；否则关闭 c 并返回 nil。
+func (this *IPLimiter) limit(c net.Conn) net.Conn {
+	if this == nil {
+		return c
+	}
+	if this.Acquire(c.RemoteAddr()) == false {
+		c.Close()
+		return nil
+	}
+	return &limitConn{Conn: c, l: this}
+}
+
+func ipOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// --------------------------------------------------------------------------------
+type limitConn struct {
+	net.Conn
+	l    *IPLimiter
+	once sync.Once
+}
+
+func (this *limitConn) Close() error {
+	this.once.Do(func() {
+		this.l.Release(this.Conn.RemoteAddr())
+	})
+	return this.Conn.Close()
+}
@@ -0,0 +1,324 @@
+package offline
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	kOpPut  = 1
+	kOpTake = 2
+
+	kRecordHeaderSize = 8
+
+	// 无效记录超过该数量并且多于有效记录时压缩文件
+	kCompactThreshold = 1024
+)
+
+// --------------------------------------------------------------------------------
+// fileStore 将消息追加写入到文件中，每条记录的格式为：长度(4 字节) + CRC32(4 字节) + 内容。
+// Take 只追加一条删除记录，无效的记录（包括定期清理的过期消息）在数量足够多时通过重写文件的方式清理。
+// 打开文件时重放所有的记录，末尾不完整或者校验失败的记录（比如进程在写入过程中崩溃）将被丢弃。
+type fileStore struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	messages map[string][]*Message
+	live     int
+	garbage  int
+	closed   chan struct{}
+}
+
+// NewFileStore 返回一个基于文件的 MessageStore，未投递的消息在进程重启之后仍然有效。
+func NewFileStore(path string) (MessageStore, error) {
+	var s = &fileStore{}
+	s.path = path
+	s.messages = make(map[string][]*Message)
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.closed = make(chan struct{})
+	go runCleanup(kCleanupInterval, s.closed, s.cleanup)
+	return s, nil
+}
+
+func (this *fileStore) load() error {
+	data, err := ioutil.ReadFile(this.path)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	var offset = 0
+	for offset+kRecordHeaderSize <= len(data) {
+		var size = int(binary.BigEndian.Uint32(data[offset:]))
+		var sum = binary.BigEndian.Uint32(data[offset+4:])
+		var end = offset + kRecordHeaderSize + size
+		if end > len(data) {
+			break
+		}
+		var payload = data[offset+kRecordHeaderSize : end]
+		if crc32.ChecksumIEEE(payload) != sum || this.replay(payload) == false {
+			break
+		}
+		offset = end
+	}
+
+	this.file, err = os.OpenFile(this.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if offset < len(data) {
+		if err = this.file.Truncate(int64(offset)); err != nil {
+			this.file.Close()
+			return err
+		}
+	}
+	if _, err = this.file.Seek(int64(offset), 0); err != nil {
+		this.file.Close()
+		return err
+	}
+	return nil
+}
+
+func (this *fileStore) replay(payload []byte) bool {
+	op, identifier, m, ok := decodeRecord(payload)
+	if ok == false {
+		return false
+	}
+
+	switch op {
+	case kOpPut:
+		this.messages[identifier] = append(this.messages[identifier], m)
+		this.live++
+	case kOpTake:
+		var n = len(this.messages[identifier])
+		delete(this.messages, identifier)
+		this.live -= n
+		this.garbage += n + 1
+	default:
+		return false
+	}
+	return true
+}
+
+func (this *fileStore) Put(identifier string, m *Message) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.file == nil {
+		return ErrStoreClosed
+	}
+
+	if err := this.append(encodeRecord(kOpPut, identifier, m)); err != nil {
+		return err
+	}
+	this.messages[identifier] = append(this.messages[identifier], m)
+	this.live++
+	return nil
+}
+
+func (this *fileStore) Take(identifier string) ([]*Message, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.file == nil {
+		return nil, ErrStoreClosed
+	}
+
+	var ml, ok = this.messages[identifier]
+	if ok == false {
+		return nil, nil
+	}
+
+	if err := this.append(encodeRecord(kOpTake, identifier, nil)); err != nil {
+		return nil, err
+	}
+	delete(this.messages, identifier)
+	this.live -= len(ml)
+	this.garbage += len(ml) + 1
+
+	this.maybeCompact()
+	return alive(ml, time.Now()), nil
+}
+
+func (this *fileStore) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	var err = this.file.Close()
+	this.file = nil
+	this.messages = nil
+	close(this.closed)
+	return err
+}
+
+// cleanup 从内存中移除过期的消息，过期消息的记录作为无效记录，由 compact 从文件中清理。
+func (this *fileStore) cleanup(now time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.file == nil {
+		return
+	}
+
+	for identifier, ml := range this.messages {
+		var nl = alive(ml, now)
+		if len(nl) == len(ml) {
+			continue
+		}
+		if len(nl) == 0 {
+			delete(this.messages, identifier)
+		} else {
+			this.messages[identifier] = nl
+		}
+		this.live -= len(ml) - len(nl)
+		this.garbage += len(ml) - len(nl)
+	}
+	this.maybeCompact()
+}
+
+func (this *fileStore) maybeCompact() {
+	if this.garbage > kCompactThreshold && this.garbage > this.live {
+		this.compact()
+	}
+}
+
+func (this *fileStore) append(payload []byte) error {
+	var b = make([]byte, kRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+	copy(b[kRecordHeaderSize:], payload)
+
+	offset, err := this.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = this.file.Write(b); err != nil {
+		// 丢弃写入了一部分的记录，避免之后的记录追加在不完整的记录后面，导致重新打开时被一起丢弃
+		this.file.Truncate(offset)
+		this.file.Seek(offset, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+// compact 将未过期的消息写入到新的文件中并替换原文件，失败时继续使用原文件。
+func (this *fileStore) compact() {
+	var tmp = this.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+
+	var old = this.file
+	this.file = f
+
+	var now = time.Now()
+	var live = 0
+	for identifier, ml := range this.messages {
+		ml = alive(ml, now)
+		for _, m := range ml {
+			if err = this.append(encodeRecord(kOpPut, identifier, m)); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		if len(ml) == 0 {
+			delete(this.messages, identifier)
+		} else {
+			this.messages[identifier] = ml
+		}
+		live += len(ml)
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, this.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		this.file = old
+		return
+	}
+
+	old.Close()
+	this.live = live
+	this.garbage = 0
+}
+
+// --------------------------------------------------------------------------------
+func encodeRecord(op byte, identifier string, m *Message) []byte {
+	var b = make([]byte, 0, 1+binary.MaxVarintLen64*3+len(identifier))
+	var buf [binary.MaxVarintLen64]byte
+
+	b = append(b, op)
+	var n = binary.PutUvarint(buf[:], uint64(len(identifier)))
+	b = append(b, buf[:n]...)
+	b = append(b, identifier...)
+
+	if m == nil {
+		return b
+	}
+
+	n = binary.PutVarint(buf[:], m.Created.UnixNano())
+	b = append(b, buf[:n]...)
+	var expires int64
+	if m.Expires.IsZero() == false {
+		expires = m.Expires.UnixNano()
+	}
+	n = binary.PutVarint(buf[:], expires)
+	b = append(b, buf[:n]...)
+	return append(b, m.Data...)
+}
+
+func decodeRecord(b []byte) (op byte, identifier string, m *Message, ok bool) {
+	if len(b) < 1 {
+		return 0, "", nil, false
+	}
+	op = b[0]
+	b = b[1:]
+
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return 0, "", nil, false
+	}
+	identifier = string(b[n : n+int(size)])
+	b = b[n+int(size):]
+
+	if op != kOpPut {
+		return op, identifier, nil, true
+	}
+
+	created, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, "", nil, false
+	}
+	b = b[n:]
+	expires, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, "", nil, false
+	}
+	b = b[n:]
+
+	m = &Message{}
+	m.Created = time.Unix(0, created)
+	if expires != 0 {
+		m.Expires = time.Unix(0, expires)
+	}
+	m.Data = append([]byte(nil), b...)
+	return op, identifier, m, true
+}
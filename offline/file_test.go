@@ -0,0 +1,128 @@
+package offline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openFileStore(t *testing.T, path string) *fileStore {
+	t.Helper()
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*fileStore)
+}
+
+func expectMessages(t *testing.T, s MessageStore, identifier string, data ...string) {
+	t.Helper()
+	ml, err := s.Take(identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ml) != len(data) {
+		t.Fatalf("expected %d messages for %s, got %d", len(data), identifier, len(ml))
+	}
+	for i, m := range ml {
+		if string(m.Data) != data[i] {
+			t.Fatalf("expected %q, got %q", data[i], m.Data)
+		}
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "offline")
+	var now = time.Now()
+
+	var s = openFileStore(t, path)
+	s.Put("a", &Message{Data: []byte("1"), Created: now})
+	s.Put("a", &Message{Data: []byte("2"), Created: now, Expires: now.Add(time.Hour)})
+	s.Put("b", &Message{Data: []byte("x"), Created: now})
+	s.Put("c", &Message{Data: []byte("y"), Created: now})
+	expectMessages(t, s, "c", "y")
+	s.Close()
+
+	s = openFileStore(t, path)
+	defer s.Close()
+	ml, _ := s.Take("a")
+	if len(ml) != 2 || ml[0].Created.Equal(now) == false || ml[1].Expires.Equal(now.Add(time.Hour)) == false {
+		t.Fatalf("unexpected messages %+v", ml)
+	}
+	expectMessages(t, s, "b", "x")
+	expectMessages(t, s, "c")
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "offline")
+
+	var s = openFileStore(t, path)
+	s.Put("a", &Message{Data: []byte("1")})
+	s.Close()
+
+	// 模拟进程在写入记录的过程中崩溃
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeRecord(kOpPut, "a", &Message{Data: []byte("2")})[:5])
+	f.Close()
+
+	// 不完整的记录被丢弃，之后写入的记录不受影响
+	s = openFileStore(t, path)
+	s.Put("a", &Message{Data: []byte("3")})
+	s.Close()
+
+	s = openFileStore(t, path)
+	defer s.Close()
+	expectMessages(t, s, "a", "1", "3")
+}
+
+func TestFileStoreCleanup(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "offline")
+	var now = time.Now()
+
+	var s = openFileStore(t, path)
+	for i := 0; i < kCompactThreshold+1; i++ {
+		s.Put("a", &Message{Data: []byte("expired"), Expires: now.Add(time.Minute)})
+	}
+	s.Put("b", &Message{Data: []byte("live")})
+
+	s.cleanup(now.Add(time.Hour))
+	if s.live != 1 || s.garbage != 0 {
+		t.Fatalf("expected expired messages to be compacted, live %d garbage %d", s.live, s.garbage)
+	}
+	s.Close()
+
+	s = openFileStore(t, path)
+	defer s.Close()
+	expectMessages(t, s, "a")
+	expectMessages(t, s, "b", "live")
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "offline")
+
+	var s = openFileStore(t, path)
+	s.Put("a", &Message{Data: []byte("keep")})
+	for i := 0; i < kCompactThreshold*3; i++ {
+		s.Put("b", &Message{Data: []byte("b")})
+		s.Take("b")
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 压缩之后文件中最多只有 kCompactThreshold 条左右的无效记录
+	var size = int64(kRecordHeaderSize + len(encodeRecord(kOpPut, "b", &Message{Data: []byte("b")})))
+	if s.garbage > kCompactThreshold || st.Size() > size*(kCompactThreshold+3) {
+		t.Fatalf("file not compacted, garbage %d size %d", s.garbage, st.Size())
+	}
+	s.Close()
+
+	s = openFileStore(t, path)
+	defer s.Close()
+	expectMessages(t, s, "a", "keep")
+}
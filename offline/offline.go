@@ -0,0 +1,225 @@
+package offline
+
+import (
+	"errors"
+	"github.com/smartwalle/bee"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStoreClosed = errors.New("offline: store is closed")
+)
+
+// --------------------------------------------------------------------------------
+type Option interface {
+	Apply(*Forwarder)
+}
+
+type optionFunc func(*Forwarder)
+
+func (f optionFunc) Apply(m *Forwarder) {
+	f(m)
+}
+
+// WithTTL 设置 Send 保存的消息的有效期，默认消息不会过期。
+func WithTTL(ttl time.Duration) Option {
+	return optionFunc(func(f *Forwarder) {
+		if ttl < 0 {
+			ttl = 0
+		}
+		f.ttl = ttl
+	})
+}
+
+// --------------------------------------------------------------------------------
+// Forwarder 将消息发送给 identifier 对应的所有 Session，identifier 没有在线的 Session 时将消息保存到 MessageStore 中，
+// 在该 identifier 的 Session 打开之后按照发送的顺序投递。
+//
+// 需要使用 Handler 包装应用的 bee.Handler，并且应用需要在 DidOpenSession 中将 Session 添加到 hub。
+type Forwarder struct {
+	hub   bee.Hub
+	store MessageStore
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	opening map[string][]bee.Session
+
+	// 每个 identifier 使用单独的锁，投递保存的消息时只阻塞该 identifier 的发送
+	lmu   sync.Mutex
+	locks map[string]*identifierLock
+}
+
+type identifierLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func New(hub bee.Hub, store MessageStore, opts ...Option) *Forwarder {
+	var f = &Forwarder{}
+	f.hub = hub
+	f.store = store
+	f.opening = make(map[string][]bee.Session)
+	f.locks = make(map[string]*identifierLock)
+
+	for _, opt := range opts {
+		opt.Apply(f)
+	}
+	return f
+}
+
+// Send 使用默认的有效期发送消息，delivered 为 true 表示消息已经交给在线的 Session，为 false 表示消息已被保存。
+// 该 identifier 有正在打开的 Session 时，消息会同时被保存，由正在打开的 Session 按照顺序接收。
+func (this *Forwarder) Send(identifier string, data []byte) (delivered bool, err error) {
+	return this.SendWithTTL(identifier, data, this.ttl)
+}
+
+// SendWithTTL 发送消息，ttl 为 0 表示保存的消息不会过期。
+func (this *Forwarder) SendWithTTL(identifier string, data []byte, ttl time.Duration) (delivered bool, err error) {
+	var unlock = this.lock(identifier)
+	defer unlock()
+
+	// 正在打开的 Session 需要先收到保存的消息，所以发送给它们的消息也需要先保存，由 deliver 按照顺序投递
+	var opening = this.openingSessions(identifier)
+	for _, s := range this.hub.GetSessions(identifier) {
+		if contains(opening, s) == false && s.WriteMessage(data) == nil {
+			delivered = true
+		}
+	}
+	if delivered && len(opening) == 0 {
+		return true, nil
+	}
+
+	var m = &Message{Data: data, Created: time.Now()}
+	if ttl > 0 {
+		m.Expires = m.Created.Add(ttl)
+	}
+	if err = this.store.Put(identifier, m); err != nil {
+		return delivered, err
+	}
+	return delivered, nil
+}
+
+// Handler 返回一个包装了 h 的 bee.Handler，在 h 的 DidOpenSession 返回之后投递保存的消息。
+func (this *Forwarder) Handler(h bee.Handler) bee.Handler {
+	return &handler{f: this, Handler: h}
+}
+
+func (this *Forwarder) openingSessions(identifier string) []bee.Session {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.opening[identifier]
+}
+
+func (this *Forwarder) beginOpen(s bee.Session) {
+	this.mu.Lock()
+	var sl = this.opening[s.Identifier()]
+	this.opening[s.Identifier()] = append(sl[:len(sl):len(sl)], s)
+	this.mu.Unlock()
+}
+
+func (this *Forwarder) endOpen(s bee.Session) {
+	this.mu.Lock()
+	var sl = this.opening[s.Identifier()]
+	var nl = make([]bee.Session, 0, len(sl))
+	for _, c := range sl {
+		if c != s {
+			nl = append(nl, c)
+		}
+	}
+	if len(nl) == 0 {
+		delete(this.opening, s.Identifier())
+	} else {
+		this.opening[s.Identifier()] = nl
+	}
+	this.mu.Unlock()
+}
+
+// deliver 投递 s 对应的 identifier 保存的消息，投递失败的消息将被重新保存。
+// 使用同步写入，避免保存的消息过多时写满 Session 的发送队列。
+func (this *Forwarder) deliver(s bee.Session) {
+	var identifier = s.Identifier()
+
+	var unlock = this.lock(identifier)
+	defer unlock()
+
+	ml, err := this.store.Take(identifier)
+	if err != nil {
+		return
+	}
+
+	for i, m := range ml {
+		if _, err = s.Write(m.Data); err != nil {
+			for _, m := range ml[i:] {
+				this.store.Put(identifier, m)
+			}
+			return
+		}
+	}
+}
+
+// lock 锁定 identifier，返回用于解锁的方法，没有被使用的锁会被移除。
+func (this *Forwarder) lock(identifier string) (unlock func()) {
+	this.lmu.Lock()
+	var l = this.locks[identifier]
+	if l == nil {
+		l = &identifierLock{}
+		this.locks[identifier] = l
+	}
+	l.refs++
+	this.lmu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		this.lmu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(this.locks, identifier)
+		}
+		this.lmu.Unlock()
+	}
+}
+
+func contains(sl []bee.Session, s bee.Session) bool {
+	for _, c := range sl {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// --------------------------------------------------------------------------------
+type handler struct {
+	f *Forwarder
+	bee.Handler
+}
+
+func (this *handler) DidOpenSession(s bee.Session) {
+	this.f.beginOpen(s)
+	if this.Handler != nil {
+		this.Handler.DidOpenSession(s)
+	}
+	this.f.deliver(s)
+	this.f.endOpen(s)
+}
+
+func (this *handler) DidClosedSession(s bee.Session, err error) {
+	if this.Handler != nil {
+		this.Handler.DidClosedSession(s, err)
+	}
+}
+
+func (this *handler) DidWrittenData(s bee.Session, data []byte) {
+	if this.Handler != nil {
+		this.Handler.DidWrittenData(s, data)
+	}
+}
+
+func (this *handler) DidReceivedData(s bee.Session, data []byte) {
+	if this.Handler != nil {
+		this.Handler.DidReceivedData(s, data)
+	}
+}
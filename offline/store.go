@@ -0,0 +1,123 @@
+package offline
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 定期清理过期的消息，避免长期不上线的 identifier 占用资源
+	kCleanupInterval = time.Minute
+)
+
+// --------------------------------------------------------------------------------
+type Message struct {
+	Data    []byte
+	Created time.Time
+	// Expires 为零值表示消息不会过期
+	Expires time.Time
+}
+
+func (this *Message) Expired(now time.Time) bool {
+	return this.Expires.IsZero() == false && now.After(this.Expires)
+}
+
+// MessageStore 保存发送给离线 identifier 的消息。
+// Take 需要按照 Put 的顺序返回 identifier 对应的所有未过期的消息，并将其从 MessageStore 中移除。
+type MessageStore interface {
+	Put(identifier string, m *Message) error
+
+	Take(identifier string) ([]*Message, error)
+
+	Close() error
+}
+
+// --------------------------------------------------------------------------------
+type memoryStore struct {
+	mu       sync.Mutex
+	messages map[string][]*Message
+	closed   chan struct{}
+}
+
+// NewMemoryStore 返回一个基于内存的 MessageStore，进程退出之后消息将丢失。
+func NewMemoryStore() MessageStore {
+	var s = &memoryStore{}
+	s.messages = make(map[string][]*Message)
+	s.closed = make(chan struct{})
+	go runCleanup(kCleanupInterval, s.closed, s.cleanup)
+	return s
+}
+
+func (this *memoryStore) Put(identifier string, m *Message) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.messages == nil {
+		return ErrStoreClosed
+	}
+
+	this.messages[identifier] = append(this.messages[identifier], m)
+	return nil
+}
+
+func (this *memoryStore) Take(identifier string) ([]*Message, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.messages == nil {
+		return nil, ErrStoreClosed
+	}
+
+	var ml = this.messages[identifier]
+	delete(this.messages, identifier)
+	return alive(ml, time.Now()), nil
+}
+
+func (this *memoryStore) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.messages != nil {
+		this.messages = nil
+		close(this.closed)
+	}
+	return nil
+}
+
+func (this *memoryStore) cleanup(now time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for identifier, ml := range this.messages {
+		if ml = alive(ml, now); len(ml) == 0 {
+			delete(this.messages, identifier)
+		} else {
+			this.messages[identifier] = ml
+		}
+	}
+}
+
+func alive(ml []*Message, now time.Time) []*Message {
+	var nl = make([]*Message, 0, len(ml))
+	for _, m := range ml {
+		if m.Expired(now) == false {
+			nl = append(nl, m)
+		}
+	}
+	return nl
+}
+
+// runCleanup 每隔 interval 调用一次 f，直到 closed 被关闭。
+func runCleanup(interval time.Duration, closed chan struct{}, f func(now time.Time)) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			f(now)
+		case <-closed:
+			return
+		}
+	}
+}
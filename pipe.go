@@ -0,0 +1,432 @@
+package bee
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kPipeBufferSize = 4 << 20
+
+	// 模拟丢包之后重传的最小等待时间
+	kPipeMinRetransmit = 200 * time.Millisecond
+)
+
+// --------------------------------------------------------------------------------
+type PipeOption interface {
+	Apply(*pipeConfig)
+}
+
+type pipeOptionFunc func(*pipeConfig)
+
+func (f pipeOptionFunc) Apply(c *pipeConfig) {
+	f(c)
+}
+
+// WithPipeLatency 设置单向的传输延迟。
+func WithPipeLatency(latency time.Duration) PipeOption {
+	return pipeOptionFunc(func(c *pipeConfig) {
+		if latency < 0 {
+			latency = 0
+		}
+		c.latency = latency
+	})
+}
+
+// WithPipeBandwidth 设置单向的带宽（字节/秒），0 表示不限制。
+func WithPipeBandwidth(bytesPerSecond int64) PipeOption {
+	return pipeOptionFunc(func(c *pipeConfig) {
+		if bytesPerSecond < 0 {
+			bytesPerSecond = 0
+		}
+		c.bandwidth = bytesPerSecond
+	})
+}
+
+// WithPipeLoss 设置丢包率，取值范围为 [0, 1]。
+// 连接本身是可靠的，丢失的数据会在模拟的重传之后到达，并且阻塞之后的数据（和 TCP 一样）；数据报则会被直接丢弃。
+func WithPipeLoss(rate float64) PipeOption {
+	return pipeOptionFunc(func(c *pipeConfig) {
+		if rate < 0 {
+			rate = 0
+		}
+		if rate > 1 {
+			rate = 1
+		}
+		c.loss = rate
+	})
+}
+
+type pipeConfig struct {
+	latency   time.Duration
+	bandwidth int64
+	loss      float64
+}
+
+// retransmit 返回丢包之后重传所需的时间。
+func (this *pipeConfig) retransmit() time.Duration {
+	var d = 2 * this.latency
+	if d < kPipeMinRetransmit {
+		d = kPipeMinRetransmit
+	}
+	return d
+}
+
+func (this *pipeConfig) lost() bool {
+	return this.loss > 0 && rand.Float64() < this.loss
+}
+
+// --------------------------------------------------------------------------------
+// PipeListener 为进程内的传输，不需要占用端口，用于测试。
+// 通过 Dial 创建的连接可以通过 Accept 获取，连接可以模拟延迟、带宽以及丢包，并且支持不可靠数据报。
+type PipeListener struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	config     pipeConfig
+	addr       pipeAddr
+	seq        uint64
+	acceptConn chan net.Conn
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func ListenPipe(name string, opts ...PipeOption) *PipeListener {
+	var l = &PipeListener{}
+	l.addr = pipeAddr(name)
+	l.acceptConn = make(chan net.Conn)
+	l.closed = make(chan struct{})
+
+	for _, opt := range opts {
+		opt.Apply(&l.config)
+	}
+	return l
+}
+
+func (this *PipeListener) Accept() (Conn, error) {
+	select {
+	case c := <-this.acceptConn:
+		return NewConn(c, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
+	case <-this.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (this *PipeListener) Addr() net.Addr {
+	return this.addr
+}
+
+// Close 停止接受新的连接，已经建立的连接不受影响。
+func (this *PipeListener) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+func (this *PipeListener) Dial() (Conn, error) {
+	return this.DialContext(context.Background())
+}
+
+// DialContext 创建连接，阻塞直到服务端通过 Accept 获取该连接。
+func (this *PipeListener) DialContext(ctx context.Context) (Conn, error) {
+	var id = atomic.AddUint64(&this.seq, 1)
+	var local = pipeAddr(string(this.addr) + "#" + strconv.FormatUint(id, 10))
+	client, server := newPipe(&this.config, local, this.addr)
+
+	select {
+	case this.acceptConn <- server:
+		return NewConn(client, false, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
+	case <-this.closed:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// --------------------------------------------------------------------------------
+type pipeAddr string
+
+func (this pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (this pipeAddr) String() string {
+	return string(this)
+}
+
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "pipe: i/o timeout" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+// --------------------------------------------------------------------------------
+type pipeSegment struct {
+	data []byte
+	at   time.Time
+}
+
+// pipeHalf 为一个方向上的数据，segments 按照到达的时间排序。
+type pipeHalf struct {
+	mu        sync.Mutex
+	config    *pipeConfig
+	segments  []*pipeSegment
+	size      int
+	busy      time.Time
+	last      time.Time
+	eof       bool
+	readable  chan struct{}
+	writable  chan struct{}
+	datagrams chan []byte
+}
+
+func newPipeHalf(config *pipeConfig) *pipeHalf {
+	var h = &pipeHalf{}
+	h.config = config
+	h.readable = make(chan struct{}, 1)
+	h.writable = make(chan struct{}, 1)
+	h.datagrams = make(chan []byte, 64)
+	return h
+}
+
+func pipeNotify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// arrival 计算数据到达对端的时间，调用者需要持有 mu。
+func (this *pipeHalf) arrival(n int) time.Time {
+	var now = time.Now()
+	if this.busy.Before(now) {
+		this.busy = now
+	}
+	if this.config.bandwidth > 0 {
+		this.busy = this.busy.Add(time.Duration(int64(n) * int64(time.Second) / this.config.bandwidth))
+	}
+	var at = this.busy.Add(this.config.latency)
+	if this.config.lost() {
+		at = at.Add(this.config.retransmit())
+	}
+	// 数据按照顺序到达
+	if at.Before(this.last) {
+		at = this.last
+	}
+	this.last = at
+	return at
+}
+
+// --------------------------------------------------------------------------------
+type pipeConn struct {
+	r      *pipeHalf
+	w      *pipeHalf
+	local  pipeAddr
+	remote pipeAddr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newPipe(config *pipeConfig, clientAddr, serverAddr pipeAddr) (client, server *pipeConn) {
+	var c2s = newPipeHalf(config)
+	var s2c = newPipeHalf(config)
+	client = &pipeConn{r: s2c, w: c2s, local: clientAddr, remote: serverAddr, closed: make(chan struct{})}
+	server = &pipeConn{r: c2s, w: s2c, local: serverAddr, remote: clientAddr, closed: make(chan struct{})}
+	return client, server
+}
+
+func (this *pipeConn) Read(b []byte) (n int, err error) {
+	for {
+		select {
+		case <-this.closed:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+
+		var now = time.Now()
+		this.mu.Lock()
+		var deadline = this.readDeadline
+		this.mu.Unlock()
+		if deadline.IsZero() == false && now.After(deadline) {
+			return 0, pipeTimeoutError{}
+		}
+
+		var r = this.r
+		r.mu.Lock()
+		var wait time.Duration = -1
+		if len(r.segments) > 0 {
+			var seg = r.segments[0]
+			if seg.at.After(now) == false {
+				n = copy(b, seg.data)
+				if n == len(seg.data) {
+					r.segments[0] = nil
+					r.segments = r.segments[1:]
+				} else {
+					seg.data = seg.data[n:]
+				}
+				r.size -= n
+				r.mu.Unlock()
+				pipeNotify(r.writable)
+				return n, nil
+			}
+			wait = seg.at.Sub(now)
+		} else if r.eof {
+			r.mu.Unlock()
+			return 0, io.EOF
+		}
+		r.mu.Unlock()
+
+		if deadline.IsZero() == false && (wait < 0 || deadline.Sub(now) < wait) {
+			wait = deadline.Sub(now)
+		}
+		this.wait(r.readable, wait)
+	}
+}
+
+func (this *pipeConn) Write(b []byte) (n int, err error) {
+	var w = this.w
+	for {
+		select {
+		case <-this.closed:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+
+		var now = time.Now()
+		this.mu.Lock()
+		var deadline = this.writeDeadline
+		this.mu.Unlock()
+		if deadline.IsZero() == false && now.After(deadline) {
+			return 0, pipeTimeoutError{}
+		}
+
+		w.mu.Lock()
+		if w.eof {
+			w.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if w.size < kPipeBufferSize {
+			var data = append([]byte(nil), b...)
+			w.segments = append(w.segments, &pipeSegment{data: data, at: w.arrival(len(data))})
+			w.size += len(data)
+			w.mu.Unlock()
+			pipeNotify(w.readable)
+			return len(b), nil
+		}
+		w.mu.Unlock()
+
+		var wait time.Duration = -1
+		if deadline.IsZero() == false {
+			wait = deadline.Sub(now)
+		}
+		this.wait(w.writable, wait)
+	}
+}
+
+// wait 等待 c 的通知，wait 小于 0 表示一直等待。
+func (this *pipeConn) wait(c chan struct{}, wait time.Duration) {
+	if wait < 0 {
+		select {
+		case <-c:
+		case <-this.closed:
+		}
+		return
+	}
+
+	var timer = time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c:
+	case <-timer.C:
+	case <-this.closed:
+	}
+}
+
+// WriteDatagram 发送不可靠数据报，数据报可能因为模拟的丢包或者对端的缓冲区已满而丢失。
+func (this *pipeConn) WriteDatagram(data []byte) error {
+	select {
+	case <-this.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	var w = this.w
+	if w.config.lost() {
+		return nil
+	}
+	var d = append([]byte(nil), data...)
+	time.AfterFunc(w.config.latency, func() {
+		select {
+		case w.datagrams <- d:
+		default:
+		}
+	})
+	return nil
+}
+
+func (this *pipeConn) ReadDatagram() ([]byte, error) {
+	select {
+	case d := <-this.r.datagrams:
+		return d, nil
+	case <-this.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+func (this *pipeConn) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+
+		// 对端读取完已经发送的数据之后返回 io.EOF
+		this.w.mu.Lock()
+		this.w.eof = true
+		this.w.mu.Unlock()
+		pipeNotify(this.w.readable)
+
+		this.r.mu.Lock()
+		this.r.eof = true
+		this.r.mu.Unlock()
+		pipeNotify(this.r.writable)
+	})
+	return nil
+}
+
+func (this *pipeConn) LocalAddr() net.Addr {
+	return this.local
+}
+
+func (this *pipeConn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func (this *pipeConn) SetDeadline(t time.Time) error {
+	this.SetReadDeadline(t)
+	return this.SetWriteDeadline(t)
+}
+
+func (this *pipeConn) SetReadDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.readDeadline = t
+	this.mu.Unlock()
+	pipeNotify(this.r.readable)
+	return nil
+}
+
+func (this *pipeConn) SetWriteDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.writeDeadline = t
+	this.mu.Unlock()
+	pipeNotify(this.w.writable)
+	return nil
+}
@@ -0,0 +1,367 @@
+package bee
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultPresenceRetention = 24 * time.Hour
+)
+
+// --------------------------------------------------------------------------------
+type PresenceEvent struct {
+	Identifier string
+	Online     bool
+	Time       time.Time
+}
+
+type PresenceInfo struct {
+	Identifier string
+	Online     bool
+	Tags       []string
+
+	// LastSeen 在线时为当前时间，离线时为最后一个 Session 被移除的时间，从未上线时为零值
+	LastSeen time.Time
+}
+
+// --------------------------------------------------------------------------------
+type PresenceOption interface {
+	Apply(*PresenceHub)
+}
+
+type presenceOptionFunc func(*PresenceHub)
+
+func (f presenceOptionFunc) Apply(h *PresenceHub) {
+	f(h)
+}
+
+// WithPresenceDebounce 设置离线事件的延迟时间，identifier 在该时间内重新上线时不会产生离线及上线事件，用于过滤频繁断线重连的连接。
+func WithPresenceDebounce(d time.Duration) PresenceOption {
+	return presenceOptionFunc(func(h *PresenceHub) {
+		h.debounce = d
+	})
+}
+
+// WithPresenceRetention 设置离线状态的保留时间，identifier 离线超过该时间之后 Presence 不再返回 LastSeen，默认为 24 小时。
+func WithPresenceRetention(d time.Duration) PresenceOption {
+	return presenceOptionFunc(func(h *PresenceHub) {
+		if d <= 0 {
+			d = kDefaultPresenceRetention
+		}
+		h.retention = d
+	})
+}
+
+// WithPresenceNotifier 设置通知订阅者的方法，subscriber 为通过 Subscribe 订阅了 e.Identifier 的 Session。
+func WithPresenceNotifier(f func(subscriber Session, e PresenceEvent)) PresenceOption {
+	return presenceOptionFunc(func(h *PresenceHub) {
+		h.notifier = f
+	})
+}
+
+// --------------------------------------------------------------------------------
+type presence struct {
+	online   bool
+	lastSeen time.Time
+	timer    *time.Timer
+
+	// expire 用于在离线超过保留时间之后移除 presence
+	expire *time.Timer
+}
+
+// PresenceHub 在 Hub 的基础上跟踪 identifier 的在线状态：identifier 的第一个 Session 被添加时产生上线事件，
+// 最后一个 Session 被移除时产生离线事件。
+// 同一个 identifier 的事件按照状态变化的顺序通知，Watch 及 WithPresenceNotifier 设置的方法中可以调用 PresenceHub 的方法。
+type PresenceHub struct {
+	Hub
+
+	mu        sync.Mutex
+	debounce  time.Duration
+	retention time.Duration
+	notifier  func(subscriber Session, e PresenceEvent)
+	m         map[string]*presence
+	watchers  map[int]func(e PresenceEvent)
+	watchId   int
+
+	// events 保存 identifier 等待通知的事件，identifier 存在时说明已经有 goroutine 在按顺序通知其事件
+	events map[string][]PresenceEvent
+
+	// identifier -> 订阅者
+	subs map[string]map[Session]struct{}
+	// 订阅者 -> identifiers
+	subOf map[Session]map[string]struct{}
+}
+
+func NewPresenceHub(h Hub, opts ...PresenceOption) *PresenceHub {
+	var ph = &PresenceHub{}
+	ph.Hub = h
+	ph.retention = kDefaultPresenceRetention
+	ph.m = make(map[string]*presence)
+	ph.watchers = make(map[int]func(e PresenceEvent))
+	ph.events = make(map[string][]PresenceEvent)
+	ph.subs = make(map[string]map[Session]struct{})
+	ph.subOf = make(map[Session]map[string]struct{})
+
+	for _, opt := range opts {
+		opt.Apply(ph)
+	}
+	return ph
+}
+
+func (this *PresenceHub) AddSession(s Session) {
+	this.TryAddSession(s)
+}
+
+func (this *PresenceHub) TryAddSession(s Session) error {
+	if s == nil {
+		return nil
+	}
+	if err := this.Hub.TryAddSession(s); err != nil {
+		return err
+	}
+	this.update(s.Identifier())
+	return nil
+}
+
+func (this *PresenceHub) RemoveSession(s Session) {
+	if s == nil {
+		return
+	}
+	this.Hub.RemoveSession(s)
+	this.Unsubscribe(s)
+	this.update(s.Identifier())
+}
+
+func (this *PresenceHub) RemoveSessions(identifier string) {
+	var sl = this.Hub.GetSessions(identifier)
+	this.Hub.RemoveSessions(identifier)
+	for _, s := range sl {
+		this.Unsubscribe(s)
+	}
+	this.update(identifier)
+}
+
+// Presence 返回 identifier 的在线状态。
+func (this *PresenceHub) Presence(identifier string) PresenceInfo {
+	var info = PresenceInfo{Identifier: identifier}
+	for _, s := range this.Hub.GetSessions(identifier) {
+		info.Tags = append(info.Tags, s.Tag())
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if p := this.m[identifier]; p != nil {
+		info.Online = p.online
+		info.LastSeen = p.lastSeen
+		if p.online {
+			info.LastSeen = time.Now()
+		}
+	}
+	return info
+}
+
+// Watch 监听所有 identifier 的上线及离线事件，返回用于取消监听的方法。
+func (this *PresenceHub) Watch(f func(e PresenceEvent)) (cancel func()) {
+	this.mu.Lock()
+	this.watchId++
+	var id = this.watchId
+	this.watchers[id] = f
+	this.mu.Unlock()
+
+	return func() {
+		this.mu.Lock()
+		delete(this.watchers, id)
+		this.mu.Unlock()
+	}
+}
+
+// Subscribe 订阅 identifiers 的上线及离线事件，事件通过 WithPresenceNotifier 设置的方法通知 subscriber。
+// subscriber 从 Hub 中移除时会自动取消订阅。
+func (this *PresenceHub) Subscribe(subscriber Session, identifiers ...string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var im = this.subOf[subscriber]
+	if im == nil {
+		im = make(map[string]struct{})
+		this.subOf[subscriber] = im
+	}
+
+	for _, identifier := range identifiers {
+		var sm = this.subs[identifier]
+		if sm == nil {
+			sm = make(map[Session]struct{})
+			this.subs[identifier] = sm
+		}
+		sm[subscriber] = struct{}{}
+		im[identifier] = struct{}{}
+	}
+}
+
+// Unsubscribe 取消订阅 identifiers，identifiers 为空时取消 subscriber 的所有订阅。
+func (this *PresenceHub) Unsubscribe(subscriber Session, identifiers ...string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var im = this.subOf[subscriber]
+	if im == nil {
+		return
+	}
+
+	if len(identifiers) == 0 {
+		for identifier := range im {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+
+	for _, identifier := range identifiers {
+		delete(im, identifier)
+		if sm := this.subs[identifier]; sm != nil {
+			delete(sm, subscriber)
+			if len(sm) == 0 {
+				delete(this.subs, identifier)
+			}
+		}
+	}
+	if len(im) == 0 {
+		delete(this.subOf, subscriber)
+	}
+}
+
+func (this *PresenceHub) update(identifier string) {
+	// 在 mu 中检查 Session 数量，同一个 identifier 的并发更新按顺序执行，最后一次更新总是能看到最新的状态
+	this.mu.Lock()
+	var online = len(this.Hub.GetSessions(identifier)) > 0
+	var p = this.m[identifier]
+	if p == nil {
+		if online == false {
+			this.mu.Unlock()
+			return
+		}
+		p = &presence{}
+		this.m[identifier] = p
+	}
+
+	if online {
+		if p.expire != nil {
+			p.expire.Stop()
+			p.expire = nil
+		}
+		if p.timer != nil {
+			// 在延迟时间内重新上线，取消离线事件
+			p.timer.Stop()
+			p.timer = nil
+			this.mu.Unlock()
+			return
+		}
+		if p.online {
+			this.mu.Unlock()
+			return
+		}
+		p.online = true
+		var drain = this.queue(PresenceEvent{Identifier: identifier, Online: true, Time: time.Now()})
+		this.mu.Unlock()
+
+		if drain {
+			this.drain(identifier)
+		}
+		return
+	}
+
+	if p.online == false || p.timer != nil {
+		this.mu.Unlock()
+		return
+	}
+
+	var now = time.Now()
+	if this.debounce <= 0 {
+		this.offline(identifier, p, now)
+		var drain = this.queue(PresenceEvent{Identifier: identifier, Online: false, Time: now})
+		this.mu.Unlock()
+
+		if drain {
+			this.drain(identifier)
+		}
+		return
+	}
+
+	p.lastSeen = now
+	var timer *time.Timer
+	timer = time.AfterFunc(this.debounce, func() {
+		this.mu.Lock()
+		if p.timer != timer {
+			this.mu.Unlock()
+			return
+		}
+		p.timer = nil
+		this.offline(identifier, p, now)
+		var drain = this.queue(PresenceEvent{Identifier: identifier, Online: false, Time: now})
+		this.mu.Unlock()
+
+		if drain {
+			this.drain(identifier)
+		}
+	})
+	p.timer = timer
+	this.mu.Unlock()
+}
+
+// offline 将 p 标记为离线，并在超过保留时间之后移除，调用时需要持有 mu。
+func (this *PresenceHub) offline(identifier string, p *presence, now time.Time) {
+	p.online = false
+	p.lastSeen = now
+
+	var expire *time.Timer
+	expire = time.AfterFunc(this.retention, func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		if p.expire == expire && this.m[identifier] == p {
+			delete(this.m, identifier)
+		}
+	})
+	p.expire = expire
+}
+
+// queue 将事件加入 identifier 的通知队列，返回 true 时调用方需要在释放 mu 之后调用 drain，调用时需要持有 mu。
+// 事件在持有 mu 时入队，入队的顺序和状态变化的顺序一致。
+func (this *PresenceHub) queue(e PresenceEvent) bool {
+	var el, draining = this.events[e.Identifier]
+	this.events[e.Identifier] = append(el, e)
+	return draining == false
+}
+
+// drain 按顺序通知 identifier 的事件，直到队列为空，通知期间加入的事件也由当前 goroutine 通知。
+func (this *PresenceHub) drain(identifier string) {
+	for {
+		this.mu.Lock()
+		var el = this.events[identifier]
+		if len(el) == 0 {
+			delete(this.events, identifier)
+			this.mu.Unlock()
+			return
+		}
+		var e = el[0]
+		this.events[identifier] = el[1:]
+
+		var watchers = make([]func(e PresenceEvent), 0, len(this.watchers))
+		for _, f := range this.watchers {
+			watchers = append(watchers, f)
+		}
+		var subscribers []Session
+		if this.notifier != nil {
+			for s := range this.subs[e.Identifier] {
+				subscribers = append(subscribers, s)
+			}
+		}
+		this.mu.Unlock()
+
+		for _, f := range watchers {
+			f(e)
+		}
+		for _, s := range subscribers {
+			this.notifier(s, e)
+		}
+	}
+}
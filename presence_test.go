@@ -0,0 +1,68 @@
+package bee
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type presenceSession struct {
+	Session
+	tag string
+}
+
+func (this *presenceSession) Identifier() string {
+	return "u1"
+}
+
+func (this *presenceSession) Tag() string {
+	return this.tag
+}
+
+func TestPresenceOrder(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		var ph = NewPresenceHub(NewHub())
+
+		var mu sync.Mutex
+		var events []PresenceEvent
+		ph.Watch(func(e PresenceEvent) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var s = &presenceSession{tag: strconv.Itoa(i)}
+				for j := 0; j < 100; j++ {
+					ph.AddSession(s)
+					ph.RemoveSession(s)
+				}
+				// 一半的轮次以在线状态结束
+				if round%2 == 0 && i == 0 {
+					ph.AddSession(s)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		mu.Lock()
+		if len(events) == 0 {
+			t.Fatal("no presence event")
+		}
+		for i, e := range events {
+			if e.Online != (i%2 == 0) {
+				t.Fatalf("round %d: event %d out of order: %+v", round, i, e)
+			}
+		}
+		var last = events[len(events)-1]
+		mu.Unlock()
+
+		if info := ph.Presence("u1"); info.Online != last.Online || info.Online != (round%2 == 0) {
+			t.Fatalf("round %d: presence %v does not match the last event %v", round, info.Online, last.Online)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package pubsub
+
+import (
+	"errors"
+	"github.com/smartwalle/bee"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidFilter = errors.New("pubsub: invalid topic filter")
+	ErrInvalidTopic  = errors.New("pubsub: invalid topic")
+)
+
+// --------------------------------------------------------------------------------
+type Option interface {
+	Apply(*PubSub)
+}
+
+type optionFunc func(*PubSub)
+
+func (f optionFunc) Apply(p *PubSub) {
+	f(p)
+}
+
+// WithDeliver 设置向 Session 投递消息的方法，默认直接调用 Session 的 WriteMessage 发送 data，
+// 如果客户端需要知道消息所属的 topic，可以在该方法中对 topic 和 data 进行编码。
+func WithDeliver(f func(s bee.Session, topic string, data []byte) error) Option {
+	return optionFunc(func(p *PubSub) {
+		p.deliver = f
+	})
+}
+
+// --------------------------------------------------------------------------------
+type node struct {
+	children map[string]*node
+	subs     map[bee.Session]struct{}
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node), subs: make(map[bee.Session]struct{})}
+}
+
+// PubSub 实现了 MQTT 风格的主题订阅，topic 使用 / 分隔层级，订阅时可以使用通配符：
+// + 匹配一个层级，# 匹配当前及之后的所有层级（只能作为最后一个层级），以 $ 开头的 topic 不会被首层级的通配符匹配。
+type PubSub struct {
+	mu       sync.RWMutex
+	root     *node
+	subs     map[bee.Session]map[string]struct{}
+	retained map[string][]byte
+	deliver  func(s bee.Session, topic string, data []byte) error
+}
+
+func New(opts ...Option) *PubSub {
+	var p = &PubSub{}
+	p.root = newNode()
+	p.subs = make(map[bee.Session]map[string]struct{})
+	p.retained = make(map[string][]byte)
+	p.deliver = func(s bee.Session, topic string, data []byte) error {
+		return s.WriteMessage(data)
+	}
+
+	for _, opt := range opts {
+		opt.Apply(p)
+	}
+	return p
+}
+
+// Handler 返回一个包装了 h 的 bee.Handler，Session 关闭时自动取消其所有订阅。
+func (this *PubSub) Handler(h bee.Handler) bee.Handler {
+	return &handler{p: this, Handler: h}
+}
+
+// Subscribe 订阅 filter，订阅成功之后会立即收到与 filter 匹配的保留消息。
+func (this *PubSub) Subscribe(s bee.Session, filter string) error {
+	if validFilter(filter) == false {
+		return ErrInvalidFilter
+	}
+
+	this.mu.Lock()
+	var n = this.root
+	for _, level := range strings.Split(filter, "/") {
+		var child = n.children[level]
+		if child == nil {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.subs[s] = struct{}{}
+
+	var fm = this.subs[s]
+	if fm == nil {
+		fm = make(map[string]struct{})
+		this.subs[s] = fm
+	}
+	fm[filter] = struct{}{}
+
+	var topics []string
+	var retained [][]byte
+	for topic, data := range this.retained {
+		if Match(filter, topic) {
+			topics = append(topics, topic)
+			retained = append(retained, data)
+		}
+	}
+	this.mu.Unlock()
+
+	for i, topic := range topics {
+		this.deliver(s, topic, retained[i])
+	}
+	return nil
+}
+
+func (this *PubSub) Unsubscribe(s bee.Session, filter string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.unsubscribe(s, filter)
+}
+
+func (this *PubSub) UnsubscribeAll(s bee.Session) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for filter := range this.subs[s] {
+		this.unsubscribe(s, filter)
+	}
+}
+
+func (this *PubSub) unsubscribe(s bee.Session, filter string) {
+	var fm = this.subs[s]
+	if _, ok := fm[filter]; ok == false {
+		return
+	}
+	delete(fm, filter)
+	if len(fm) == 0 {
+		delete(this.subs, s)
+	}
+
+	var levels = strings.Split(filter, "/")
+	var path = make([]*node, 0, len(levels)+1)
+	var n = this.root
+	path = append(path, n)
+	for _, level := range levels {
+		if n = n.children[level]; n == nil {
+			return
+		}
+		path = append(path, n)
+	}
+	delete(n.subs, s)
+
+	// 清理空的节点
+	for i := len(levels) - 1; i >= 0; i-- {
+		var child = path[i+1]
+		if len(child.subs) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// Publish 向订阅了与 topic 匹配的 filter 的 Session 发布消息，返回接收到消息的 Session 数量。
+// retain 为 true 时保存该消息作为 topic 的保留消息，data 为空时删除 topic 的保留消息。
+func (this *PubSub) Publish(topic string, data []byte, retain bool) (int, error) {
+	if validTopic(topic) == false {
+		return 0, ErrInvalidTopic
+	}
+
+	if retain {
+		this.mu.Lock()
+		if len(data) == 0 {
+			delete(this.retained, topic)
+		} else {
+			this.retained[topic] = data
+		}
+		this.mu.Unlock()
+	}
+
+	var sl = this.Subscribers(topic)
+	for _, s := range sl {
+		this.deliver(s, topic, data)
+	}
+	return len(sl), nil
+}
+
+// Subscribers 返回订阅了与 topic 匹配的 filter 的 Session，同一个 Session 只会出现一次。
+func (this *PubSub) Subscribers(topic string) []bee.Session {
+	var levels = strings.Split(topic, "/")
+	var sm = make(map[bee.Session]struct{})
+
+	this.mu.RLock()
+	match(this.root, levels, 0, sm)
+	this.mu.RUnlock()
+
+	var sl = make([]bee.Session, 0, len(sm))
+	for s := range sm {
+		sl = append(sl, s)
+	}
+	return sl
+}
+
+// Retained 返回 topic 的保留消息。
+func (this *PubSub) Retained(topic string) []byte {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.retained[topic]
+}
+
+func match(n *node, levels []string, i int, sm map[bee.Session]struct{}) {
+	var wildcard = i > 0 || strings.HasPrefix(levels[0], "$") == false
+
+	if wildcard {
+		if child := n.children["#"]; child != nil {
+			for s := range child.subs {
+				sm[s] = struct{}{}
+			}
+		}
+	}
+
+	if i == len(levels) {
+		for s := range n.subs {
+			sm[s] = struct{}{}
+		}
+		return
+	}
+
+	if child := n.children[levels[i]]; child != nil {
+		match(child, levels, i+1, sm)
+	}
+	if wildcard {
+		if child := n.children["+"]; child != nil {
+			match(child, levels, i+1, sm)
+		}
+	}
+}
+
+// Match 判断 topic 是否与 filter 匹配。
+func Match(filter, topic string) bool {
+	var fl = strings.Split(filter, "/")
+	var tl = strings.Split(topic, "/")
+
+	if strings.HasPrefix(topic, "$") && (fl[0] == "+" || fl[0] == "#") {
+		return false
+	}
+
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if f != "+" && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	var levels = strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+func validTopic(topic string) bool {
+	return topic != "" && strings.ContainsAny(topic, "+#") == false
+}
+
+// --------------------------------------------------------------------------------
+type handler struct {
+	p *PubSub
+	bee.Handler
+}
+
+func (this *handler) DidClosedSession(s bee.Session, err error) {
+	this.p.UnsubscribeAll(s)
+	if this.Handler != nil {
+		this.Handler.DidClosedSession(s, err)
+	}
+}
+
+func (this *handler) DidOpenSession(s bee.Session) {
+	if this.Handler != nil {
+		this.Handler.DidOpenSession(s)
+	}
+}
+
+func (this *handler) DidWrittenData(s bee.Session, data []byte) {
+	if this.Handler != nil {
+		this.Handler.DidWrittenData(s, data)
+	}
+}
+
+func (this *handler) DidReceivedData(s bee.Session, data []byte) {
+	if this.Handler != nil {
+		this.Handler.DidReceivedData(s, data)
+	}
+}
@@ -0,0 +1,177 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smartwalle/bee"
+	"github.com/smartwalle/bee/beetest"
+)
+
+const kTestTimeout = time.Second
+
+// keySession 只用于作为订阅者的 key。
+type keySession struct {
+	bee.Session
+}
+
+func TestMatch(t *testing.T) {
+	var tests = []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"+", "a/b", false},
+		{"a/+", "a/", true},
+
+		{"#", "a", true},
+		{"#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"a/+/#", "a/b", true},
+		{"+/b/#", "a/b/c/d", true},
+
+		// 以 $ 开头的 topic 不会被首层级的通配符匹配
+		{"#", "$sys/a", false},
+		{"+/a", "$sys/a", false},
+		{"$sys/#", "$sys/a", true},
+		{"$sys/+", "$sys/a", true},
+		{"a/#", "a/$b", true},
+		{"a/+", "a/$b", true},
+	}
+
+	for _, test := range tests {
+		if got := Match(test.filter, test.topic); got != test.match {
+			t.Fatalf("Match(%q, %q): expected %v, got %v", test.filter, test.topic, test.match, got)
+		}
+
+		// 订阅树的匹配结果需要和 Match 一致
+		var p = New()
+		var s = &keySession{}
+		if err := p.Subscribe(s, test.filter); err != nil {
+			t.Fatalf("subscribe %q: %v", test.filter, err)
+		}
+		if got := len(p.Subscribers(test.topic)) == 1; got != test.match {
+			t.Fatalf("Subscribers(%q) with filter %q: expected %v, got %v", test.topic, test.filter, test.match, got)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	var p = New()
+	var s = &keySession{}
+
+	for _, filter := range []string{"", "a/#/b", "a#", "#/a", "a+", "a/+b"} {
+		if err := p.Subscribe(s, filter); err != ErrInvalidFilter {
+			t.Fatalf("filter %q: expected ErrInvalidFilter, got %v", filter, err)
+		}
+	}
+	for _, topic := range []string{"", "a/+", "a/#", "a/b+"} {
+		if _, err := p.Publish(topic, []byte("x"), false); err != ErrInvalidTopic {
+			t.Fatalf("topic %q: expected ErrInvalidTopic, got %v", topic, err)
+		}
+	}
+}
+
+func TestRetained(t *testing.T) {
+	defer beetest.CheckLeaks(t)()
+
+	var p = New()
+	var server = beetest.NewServer(p.Handler(nil))
+	defer server.Close()
+
+	client, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	s, err := server.ExpectSession(kTestTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Publish("a/b", []byte("retained"), true)
+	p.Publish("a/c", []byte("cleared"), true)
+	p.Publish("a/c", nil, true)
+	p.Publish("b/c", []byte("other"), true)
+	if p.Retained("a/c") != nil {
+		t.Fatal("empty message did not clear the retained message")
+	}
+
+	// 订阅时收到匹配的保留消息，之后收到新发布的消息
+	if err = p.Subscribe(s, "a/+"); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Run(beetest.Expect([]byte("retained"), kTestTimeout)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := p.Publish("a/d", []byte("live"), false); n != 1 {
+		t.Fatalf("expected 1 subscriber, got %d", n)
+	}
+	if n, _ := p.Publish("b/d", []byte("ignored"), false); n != 0 {
+		t.Fatalf("expected no subscriber, got %d", n)
+	}
+	if err = client.Run(beetest.Expect([]byte("live"), kTestTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if p.Retained("a/d") != nil {
+		t.Fatal("message published without retain was retained")
+	}
+}
+
+func TestAutoUnsubscribe(t *testing.T) {
+	defer beetest.CheckLeaks(t)()
+
+	var p = New()
+	var server = beetest.NewServer(p.Handler(nil))
+	defer server.Close()
+
+	client, err := server.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.ExpectSession(kTestTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Subscribe(s, "a/#")
+	p.Subscribe(s, "+/b")
+	if sl := p.Subscribers("a/b"); len(sl) != 1 || sl[0] != s {
+		t.Fatalf("expected 1 subscriber, got %d", len(sl))
+	}
+
+	if err = client.Run(beetest.Disconnect()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Recorder.ExpectEvent(beetest.EventClosed, kTestTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recorder 在调用 Handler 之前记录事件，等待 Handler 取消订阅
+	var deadline = time.Now().Add(kTestTimeout)
+	for len(p.Subscribers("a/b")) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed session is still subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.subs) != 0 || len(p.root.children) != 0 {
+		t.Fatal("subscription tree was not cleaned up")
+	}
+}
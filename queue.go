@@ -0,0 +1,340 @@
+package bee
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull = errors.New("queue is full")
+
+	errQueueOverflow = errors.New("queue overflow")
+)
+
+// --------------------------------------------------------------------------------
+// Priority 为消息的优先级，write goroutine 总是先发送优先级高的消息，相同优先级的消息按照先进先出的顺序发送。
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	kPriorityCount = 3
+)
+
+// DropPolicy 决定某个优先级的队列已满时如何处理新的消息。
+type DropPolicy int
+
+const (
+	// DropClose 关闭 Session，为默认的处理方式
+	DropClose DropPolicy = iota
+
+	// DropNewest 丢弃新的消息，WriteMessage 返回 ErrQueueFull
+	DropNewest
+
+	// DropOldest 丢弃队列中最早的消息
+	DropOldest
+)
+
+// WithQueue 设置优先级 p 的队列长度及队列已满时的处理方式，未设置的优先级使用 WithWriteBufferSize 设置的长度以及 DropClose。
+func WithQueue(p Priority, size int, policy DropPolicy) Option {
+	return optionFunc(func(s *session) {
+		if p < PriorityLow || p > PriorityHigh {
+			return
+		}
+		if size <= 0 {
+			size = kDefaultWriteBufferSize
+		}
+		s.queues[p] = &queueConfig{size: size, policy: policy}
+	})
+}
+
+type queueConfig struct {
+	size   int
+	policy DropPolicy
+}
+
+// --------------------------------------------------------------------------------
+type MessageOption interface {
+	Apply(*message)
+}
+
+type messageOptionFunc func(*message)
+
+func (f messageOptionFunc) Apply(m *message) {
+	f(m)
+}
+
+// MessagePriority 设置消息的优先级，默认为 PriorityNormal。
+func MessagePriority(p Priority) MessageOption {
+	return messageOptionFunc(func(m *message) {
+		if p < PriorityLow {
+			p = PriorityLow
+		}
+		if p > PriorityHigh {
+			p = PriorityHigh
+		}
+		m.priority = p
+	})
+}
+
+// MessageTTL 设置消息的有效期，消息在发送之前过期将被丢弃，默认不会过期。
+func MessageTTL(ttl time.Duration) MessageOption {
+	return messageOptionFunc(func(m *message) {
+		if ttl <= 0 {
+			m.expires = time.Time{}
+			return
+		}
+		m.expires = time.Now().Add(ttl)
+	})
+}
+
+// MessageKey 设置消息的合并 key，发送队列中 key 相同并且尚未发送的消息将被新的消息替换，只发送最新的值，
+// 适用于状态、位置等只关心最新值的消息。
+func MessageKey(key string) MessageOption {
+	return messageOptionFunc(func(m *message) {
+		m.key = key
+	})
+}
+
+type message struct {
+	data     []byte
+	priority Priority
+	expires  time.Time
+	key      string
+}
+
+func (this *message) expired(now time.Time) bool {
+	return this.expires.IsZero() == false && now.After(this.expires)
+}
+
+// --------------------------------------------------------------------------------
+type SessionStats struct {
+	// Queued 为发送队列中等待发送的消息数量
+	Queued int
+
+	// Dropped 为队列已满时按照 DropNewest 或者 DropOldest 丢弃的消息数量
+	Dropped uint64
+
+	// Expired 为过期之后被丢弃的消息数量
+	Expired uint64
+
+	// Coalesced 为被 key 相同的新消息替换的消息数量
+	Coalesced uint64
+}
+
+// --------------------------------------------------------------------------------
+type queue struct {
+	size   int
+	policy DropPolicy
+	items  []*message
+}
+
+// outbox 为 Session 的发送队列，每个优先级使用独立的队列，Session 断开等待恢复期间队列中的消息会被保留。
+type outbox struct {
+	mu     sync.Mutex
+	queues [kPriorityCount]queue
+	notify chan struct{}
+	closed bool
+
+	// keys 记录队列中带有合并 key 的消息
+	keys map[string]*message
+
+	dropped   uint64
+	expired   uint64
+	coalesced uint64
+}
+
+func newOutbox(size int, configs [kPriorityCount]*queueConfig) *outbox {
+	var o = &outbox{}
+	o.notify = make(chan struct{}, 1)
+	for i := range o.queues {
+		o.queues[i].size = size
+		o.queues[i].policy = DropClose
+		if c := configs[i]; c != nil {
+			o.queues[i].size = c.size
+			o.queues[i].policy = c.policy
+		}
+	}
+	return o
+}
+
+// push 将消息加入队列，队列已满并且处理方式为 DropClose 时返回 errQueueOverflow，调用者需要关闭 Session。
+func (this *outbox) push(m *message) error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return errSessionClosed
+	}
+
+	var old *message
+	if m.key != "" {
+		if old = this.keys[m.key]; old != nil && old.priority == m.priority {
+			// 替换原消息的内容，保留其在队列中的位置
+			this.coalesced++
+			old.data = m.data
+			old.expires = m.expires
+			this.mu.Unlock()
+			return nil
+		}
+	}
+
+	// 优先级不同时，新消息被接受之后才移除原消息，新消息被拒绝时原消息保留在队列中
+	var q = &this.queues[m.priority]
+	if len(q.items) >= q.size {
+		switch q.policy {
+		case DropNewest:
+			this.dropped++
+			this.mu.Unlock()
+			return ErrQueueFull
+		case DropOldest:
+			this.dropped++
+			this.forget(q.items[0])
+			q.items[0] = nil
+			q.items = q.items[1:]
+		default:
+			this.mu.Unlock()
+			return errQueueOverflow
+		}
+	}
+	if old != nil {
+		this.coalesced++
+		this.remove(old)
+	}
+	q.items = append(q.items, m)
+	if m.key != "" {
+		if this.keys == nil {
+			this.keys = make(map[string]*message)
+		}
+		this.keys[m.key] = m
+	}
+
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+	this.mu.Unlock()
+	return nil
+}
+
+// pop 返回优先级最高并且没有过期的消息，过期的消息将被丢弃，队列为空时返回 nil。
+func (this *outbox) pop() (m *message, closed bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return nil, true
+	}
+
+	var now = time.Now()
+	for i := kPriorityCount - 1; i >= 0; i-- {
+		var q = &this.queues[i]
+		for len(q.items) > 0 {
+			m = q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			this.forget(m)
+			if m.expired(now) {
+				this.expired++
+				continue
+			}
+			return m, false
+		}
+	}
+	return nil, false
+}
+
+// requeue 将发送失败的消息放回队列的头部，Session 恢复之后重新发送。
+func (this *outbox) requeue(m *message) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return
+	}
+	if m.key != "" {
+		// 已经有 key 相同的新消息，丢弃发送失败的旧消息
+		if this.keys[m.key] != nil {
+			return
+		}
+		if this.keys == nil {
+			this.keys = make(map[string]*message)
+		}
+		this.keys[m.key] = m
+	}
+	var q = &this.queues[m.priority]
+	q.items = append([]*message{m}, q.items...)
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+}
+
+// takeAll 按照发送的顺序取出队列中所有未过期的消息。
+func (this *outbox) takeAll() []*message {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var now = time.Now()
+	var ml []*message
+	for i := kPriorityCount - 1; i >= 0; i-- {
+		var q = &this.queues[i]
+		for _, m := range q.items {
+			if m.expired(now) == false {
+				ml = append(ml, m)
+			}
+		}
+		q.items = nil
+	}
+	this.keys = nil
+	return ml
+}
+
+// remove 将消息从队列中移除，调用者需要持有 mu。
+func (this *outbox) remove(m *message) {
+	var q = &this.queues[m.priority]
+	for i, item := range q.items {
+		if item == m {
+			copy(q.items[i:], q.items[i+1:])
+			q.items[len(q.items)-1] = nil
+			q.items = q.items[:len(q.items)-1]
+			break
+		}
+	}
+	this.forget(m)
+}
+
+// forget 删除消息的合并 key，调用者需要持有 mu。
+func (this *outbox) forget(m *message) {
+	if m.key != "" && this.keys[m.key] == m {
+		delete(this.keys, m.key)
+	}
+}
+
+func (this *outbox) stats() SessionStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var stats = SessionStats{Dropped: this.dropped, Expired: this.expired, Coalesced: this.coalesced}
+	for i := range this.queues {
+		stats.Queued += len(this.queues[i].items)
+	}
+	return stats
+}
+
+func (this *outbox) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return
+	}
+	this.closed = true
+	for i := range this.queues {
+		this.queues[i].items = nil
+	}
+	this.keys = nil
+	close(this.notify)
+}
@@ -0,0 +1,273 @@
+package bee
+
+import (
+	"testing"
+	"time"
+)
+
+type queueOp struct {
+	data     string
+	priority Priority
+	key      string
+	expired  bool
+	err      error
+}
+
+func (this queueOp) message() *message {
+	var m = &message{data: []byte(this.data), priority: this.priority, key: this.key}
+	if this.expired {
+		m.expires = time.Now().Add(-time.Second)
+	}
+	return m
+}
+
+func queueConfigs(p Priority, size int, policy DropPolicy) [kPriorityCount]*queueConfig {
+	var configs [kPriorityCount]*queueConfig
+	configs[p] = &queueConfig{size: size, policy: policy}
+	return configs
+}
+
+// popAll 按照发送的顺序取出队列中的消息。
+func popAll(t *testing.T, o *outbox) []string {
+	t.Helper()
+	var sl []string
+	for {
+		m, closed := o.pop()
+		if closed {
+			t.Fatal("outbox closed")
+		}
+		if m == nil {
+			return sl
+		}
+		sl = append(sl, string(m.data))
+	}
+}
+
+func expectOrder(t *testing.T, name string, got, expect []string) {
+	t.Helper()
+	if len(got) != len(expect) {
+		t.Fatalf("%s: expected %v, got %v", name, expect, got)
+	}
+	for i := range got {
+		if got[i] != expect[i] {
+			t.Fatalf("%s: expected %v, got %v", name, expect, got)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	var tests = []struct {
+		name    string
+		configs [kPriorityCount]*queueConfig
+		ops     []queueOp
+		expect  []string
+		stats   SessionStats
+	}{
+		{
+			name: "priority",
+			ops: []queueOp{
+				{data: "l1", priority: PriorityLow},
+				{data: "n1", priority: PriorityNormal},
+				{data: "h1", priority: PriorityHigh},
+				{data: "n2", priority: PriorityNormal},
+				{data: "l2", priority: PriorityLow},
+				{data: "h2", priority: PriorityHigh},
+			},
+			expect: []string{"h1", "h2", "n1", "n2", "l1", "l2"},
+		},
+		{
+			name:    "drop close",
+			configs: queueConfigs(PriorityNormal, 2, DropClose),
+			ops: []queueOp{
+				{data: "n1", priority: PriorityNormal},
+				{data: "n2", priority: PriorityNormal},
+				{data: "n3", priority: PriorityNormal, err: errQueueOverflow},
+			},
+			expect: []string{"n1", "n2"},
+		},
+		{
+			name:    "drop newest",
+			configs: queueConfigs(PriorityNormal, 2, DropNewest),
+			ops: []queueOp{
+				{data: "n1", priority: PriorityNormal},
+				{data: "n2", priority: PriorityNormal},
+				{data: "n3", priority: PriorityNormal, err: ErrQueueFull},
+			},
+			expect: []string{"n1", "n2"},
+			stats:  SessionStats{Dropped: 1},
+		},
+		{
+			name:    "drop oldest",
+			configs: queueConfigs(PriorityNormal, 2, DropOldest),
+			ops: []queueOp{
+				{data: "n1", priority: PriorityNormal},
+				{data: "n2", priority: PriorityNormal},
+				{data: "n3", priority: PriorityNormal},
+			},
+			expect: []string{"n2", "n3"},
+			stats:  SessionStats{Dropped: 1},
+		},
+		{
+			name:    "independent queues",
+			configs: queueConfigs(PriorityLow, 1, DropNewest),
+			ops: []queueOp{
+				{data: "l1", priority: PriorityLow},
+				{data: "l2", priority: PriorityLow, err: ErrQueueFull},
+				{data: "h1", priority: PriorityHigh},
+			},
+			expect: []string{"h1", "l1"},
+			stats:  SessionStats{Dropped: 1},
+		},
+		{
+			name: "ttl",
+			ops: []queueOp{
+				{data: "h1", priority: PriorityHigh, expired: true},
+				{data: "n1", priority: PriorityNormal},
+				{data: "n2", priority: PriorityNormal, expired: true},
+			},
+			expect: []string{"n1"},
+			stats:  SessionStats{Expired: 2},
+		},
+		{
+			name: "coalesce",
+			ops: []queueOp{
+				{data: "a1", priority: PriorityNormal, key: "a"},
+				{data: "n1", priority: PriorityNormal},
+				{data: "a2", priority: PriorityNormal, key: "a"},
+			},
+			expect: []string{"a2", "n1"},
+			stats:  SessionStats{Coalesced: 1},
+		},
+		{
+			name: "coalesce across priorities",
+			ops: []queueOp{
+				{data: "a1", priority: PriorityLow, key: "a"},
+				{data: "n1", priority: PriorityNormal},
+				{data: "a2", priority: PriorityHigh, key: "a"},
+			},
+			expect: []string{"a2", "n1"},
+			stats:  SessionStats{Coalesced: 1},
+		},
+		{
+			name:    "coalesce rejected",
+			configs: queueConfigs(PriorityHigh, 1, DropNewest),
+			ops: []queueOp{
+				{data: "a1", priority: PriorityLow, key: "a"},
+				{data: "h1", priority: PriorityHigh},
+				{data: "a2", priority: PriorityHigh, key: "a", err: ErrQueueFull},
+			},
+			expect: []string{"h1", "a1"},
+			stats:  SessionStats{Dropped: 1},
+		},
+	}
+
+	for _, test := range tests {
+		var o = newOutbox(kDefaultWriteBufferSize, test.configs)
+		for _, op := range test.ops {
+			if err := o.push(op.message()); err != op.err {
+				t.Fatalf("%s: push %s expected %v, got %v", test.name, op.data, op.err, err)
+			}
+		}
+		if stats := o.stats(); stats.Queued == 0 {
+			t.Fatalf("%s: no message queued", test.name)
+		}
+		expectOrder(t, test.name, popAll(t, o), test.expect)
+
+		var stats = o.stats()
+		if stats != test.stats {
+			t.Fatalf("%s: expected stats %+v, got %+v", test.name, test.stats, stats)
+		}
+		if len(o.keys) != 0 {
+			t.Fatalf("%s: %d keys left after pop", test.name, len(o.keys))
+		}
+	}
+}
+
+func TestOutboxRequeue(t *testing.T) {
+	var tests = []struct {
+		name   string
+		before []queueOp
+		after  []queueOp
+		expect []string
+	}{
+		{
+			name:   "head",
+			before: []queueOp{{data: "n1", priority: PriorityNormal}, {data: "n2", priority: PriorityNormal}},
+			expect: []string{"n1", "n2"},
+		},
+		{
+			name:   "priority",
+			before: []queueOp{{data: "n1", priority: PriorityNormal}, {data: "l1", priority: PriorityLow}},
+			after:  []queueOp{{data: "h1", priority: PriorityHigh}},
+			expect: []string{"h1", "n1", "l1"},
+		},
+		{
+			name:   "superseded",
+			before: []queueOp{{data: "a1", priority: PriorityNormal, key: "a"}, {data: "n1", priority: PriorityNormal}},
+			after:  []queueOp{{data: "a2", priority: PriorityNormal, key: "a"}},
+			expect: []string{"n1", "a2"},
+		},
+		{
+			name:   "coalesce requeued",
+			before: []queueOp{{data: "a1", priority: PriorityNormal, key: "a"}, {data: "n1", priority: PriorityNormal}},
+			expect: []string{"a1", "n1"},
+		},
+	}
+
+	for _, test := range tests {
+		var o = newOutbox(kDefaultWriteBufferSize, [kPriorityCount]*queueConfig{})
+		for _, op := range test.before {
+			o.push(op.message())
+		}
+
+		// 第一条消息发送失败
+		m, _ := o.pop()
+		for _, op := range test.after {
+			o.push(op.message())
+		}
+		o.requeue(m)
+
+		expectOrder(t, test.name, popAll(t, o), test.expect)
+	}
+
+	// 重新放回队列的消息仍然可以被合并
+	var o = newOutbox(kDefaultWriteBufferSize, [kPriorityCount]*queueConfig{})
+	o.push(queueOp{data: "a1", key: "a"}.message())
+	m, _ := o.pop()
+	o.requeue(m)
+	o.push(queueOp{data: "a2", key: "a"}.message())
+	expectOrder(t, "coalesce after requeue", popAll(t, o), []string{"a2"})
+}
+
+func TestOutboxTakeAll(t *testing.T) {
+	var o = newOutbox(kDefaultWriteBufferSize, [kPriorityCount]*queueConfig{})
+	for _, op := range []queueOp{
+		{data: "l1", priority: PriorityLow},
+		{data: "n1", priority: PriorityNormal, expired: true},
+		{data: "h1", priority: PriorityHigh, key: "a"},
+		{data: "n2", priority: PriorityNormal},
+	} {
+		o.push(op.message())
+	}
+
+	var got []string
+	for _, m := range o.takeAll() {
+		got = append(got, string(m.data))
+	}
+	expectOrder(t, "take all", got, []string{"h1", "n2", "l1"})
+
+	if m, _ := o.pop(); m != nil {
+		t.Fatalf("expected empty outbox, got %q", m.data)
+	}
+	if len(o.keys) != 0 {
+		t.Fatal("keys left after take all")
+	}
+
+	o.close()
+	if _, closed := o.pop(); closed == false {
+		t.Fatal("expected pop to report closed")
+	}
+	if err := o.push(queueOp{data: "x"}.message()); err != errSessionClosed {
+		t.Fatalf("expected errSessionClosed, got %v", err)
+	}
+}
@@ -4,18 +4,56 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"github.com/lucas-clemente/quic-go"
+	"github.com/quic-go/quic-go"
 	"github.com/smartwalle/bee/conn"
+	"io"
 	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// kQUICProtocol 为 tls.Config 没有设置 NextProtos 时使用的 ALPN，QUIC 要求客户端和服务端协商应用层协议
+	kQUICProtocol = "bee"
+
+	kQUICTokenOrigins    = 64
+	kQUICTokensPerOrigin = 4
+)
+
+var (
+	ErrMigrationNotSupported = errors.New("migration is not supported")
+)
+
+var (
+	defaultQUICSessionCache = tls.NewLRUClientSessionCache(0)
+	defaultQUICTokenStore   = quic.NewLRUTokenStore(kQUICTokenOrigins, kQUICTokensPerOrigin)
 )
 
 // --------------------------------------------------------------------------------
+// QUICDialer 会为每个 QUICDialer 维护一个 TLS 会话缓存及地址验证 token（除非 tlsConf 和 config 中已经指定），
+// 重复使用同一个 QUICDialer 重连时可以复用 TLS 会话并使用 0-RTT，在握手完成之前就开始发送数据。
+// 服务端拒绝 0-RTT 时，握手完成之前写入的数据会在握手完成之后自动重新发送。
+// DialQUIC 和 DialQUICWithConn 使用包级别共享的 TLS 会话缓存及地址验证 token。
+//
+// 设置 PacketConn 之后，所有的连接都将复用该 UDP socket，而不是为每个连接创建新的 socket，
+// 由调用者负责关闭 PacketConn。
+//
+// 客户端的网络发生变化（比如从 Wi-Fi 切换到蜂窝网络）之后，可以通过 MigrateQUIC 将连接迁移到新的 UDP socket，Session 不会断开。
+// 服务端按照 Connection ID 区分连接，客户端 NAT 重新绑定端口也不会导致连接断开。
 type QUICDialer struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	WriteBufferPool conn.BufferPool
+	PacketConn      net.PacketConn
 	tlsConf         *tls.Config
 	config          *quic.Config
+
+	sessionCache tls.ClientSessionCache
+	tokenStore   quic.TokenStore
+
+	once         sync.Once
+	tlsShared    *tls.Config
+	configShared *quic.Config
 }
 
 func NewQUICDialer(tlsConf *tls.Config, config *quic.Config) *QUICDialer {
@@ -25,114 +63,392 @@ func NewQUICDialer(tlsConf *tls.Config, config *quic.Config) *QUICDialer {
 	return d
 }
 
+func (this *QUICDialer) init() {
+	this.once.Do(func() {
+		this.tlsShared = quicTLSConfig(this.tlsConf)
+		if this.tlsShared.ClientSessionCache == nil {
+			if this.sessionCache == nil {
+				this.sessionCache = tls.NewLRUClientSessionCache(0)
+			}
+			this.tlsShared.ClientSessionCache = this.sessionCache
+		}
+
+		this.configShared = quicConfig(this.config)
+		if this.configShared.TokenStore == nil {
+			if this.tokenStore == nil {
+				this.tokenStore = quic.NewLRUTokenStore(kQUICTokenOrigins, kQUICTokensPerOrigin)
+			}
+			this.configShared.TokenStore = this.tokenStore
+		}
+	})
+}
+
+// dial 建立 QUIC 连接，pConn 为 nil 时使用 PacketConn 或者创建新的 UDP socket，early 为 true 时尽可能使用 0-RTT。
+// 返回的 owned 需要在连接关闭时关闭，用于释放 UDP socket 及 quic.Transport。
+func (this *QUICDialer) dial(ctx context.Context, pConn net.PacketConn, addr string, early bool) (qc *quic.Conn, owned io.Closer, err error) {
+	this.init()
+
+	if pConn == nil {
+		pConn = this.PacketConn
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr, owned, err := acquireTransport(pConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tlsConf = serverName(this.tlsShared, addr)
+	if early {
+		qc, err = tr.DialEarly(ctx, raddr, tlsConf, this.configShared)
+	} else {
+		qc, err = tr.Dial(ctx, raddr, tlsConf, this.configShared)
+	}
+	if err != nil {
+		owned.Close()
+		return nil, nil, err
+	}
+	return qc, owned, nil
+}
+
 func (this *QUICDialer) Dial(network, addr string) (Conn, error) {
 	return this.DialContext(context.Background(), network, addr)
 }
 
 func (this *QUICDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-	if err != nil {
-		return nil, err
-	}
-	return this.DialConnContext(ctx, udpConn, addr)
+	return this.dialConn(ctx, nil, addr)
 }
 
 func (this *QUICDialer) DialConnContext(ctx context.Context, pConn net.PacketConn, addr string) (Conn, error) {
-	raddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
-	}
+	return this.dialConn(ctx, pConn, addr)
+}
 
-	sess, err := quic.DialContext(ctx, pConn, raddr, addr, this.tlsConf, this.config)
+func (this *QUICDialer) dialConn(ctx context.Context, pConn net.PacketConn, addr string) (Conn, error) {
+	qc, owned, err := this.dial(ctx, pConn, addr, true)
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := sess.OpenStream()
+	stream, err := qc.OpenStream()
 	if err != nil {
-		sess.Close()
+		qc.CloseWithError(0, "")
+		owned.Close()
 		return nil, err
 	}
 
-	if stream == nil {
-		sess.Close()
-		return nil, errors.New("closed stream")
+	c := newQSession(qc, stream, newQDatagrams(qc), owned)
+	select {
+	case <-qc.HandshakeComplete():
+	default:
+		// DialEarly 在握手完成之前返回，说明使用了 0-RTT
+		c.zeroRTT = true
 	}
-
-	c := &qSession{sess: sess, Stream: stream}
 	return NewConn(c, false, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
 }
 
 func DialQUIC(addr string, tlsConf *tls.Config, config *quic.Config) (Conn, error) {
-	var d QUICDialer
-	d.tlsConf = tlsConf
-	d.config = config
+	var d = newDefaultQUICDialer(tlsConf, config)
 	return d.DialContext(context.Background(), "", addr)
 }
 
 func DialQUICWithConn(pConn net.PacketConn, addr string, tlsConf *tls.Config, config *quic.Config) (Conn, error) {
-	var d QUICDialer
-	d.tlsConf = tlsConf
-	d.config = config
+	var d = newDefaultQUICDialer(tlsConf, config)
 	return d.DialConnContext(context.Background(), pConn, addr)
 }
 
+func newDefaultQUICDialer(tlsConf *tls.Config, config *quic.Config) *QUICDialer {
+	var d = NewQUICDialer(tlsConf, config)
+	d.sessionCache = defaultQUICSessionCache
+	d.tokenStore = defaultQUICTokenStore
+	return d
+}
+
+// MigrateQUIC 将 c 所在的 QUIC 连接迁移到 pConn 上（比如客户端从 Wi-Fi 切换到蜂窝网络之后，使用新网络的 UDP socket），
+// 迁移之后 Session 不会断开。pConn 为 nil 时创建新的 UDP socket，该 socket 在连接关闭时一并关闭。
+// c 需要为 QUICDialer 创建的连接，否则返回 ErrMigrationNotSupported。
+func MigrateQUIC(ctx context.Context, c Conn, pConn net.PacketConn) error {
+	uc, ok := c.(interface{ UnderlyingConn() net.Conn })
+	if ok == false {
+		return ErrMigrationNotSupported
+	}
+	qs, ok := uc.UnderlyingConn().(*qSession)
+	if ok == false {
+		return ErrMigrationNotSupported
+	}
+	owned, err := migrate(ctx, qs.conn, pConn)
+	if err != nil {
+		return err
+	}
+	return qs.own(owned)
+}
+
+func migrate(ctx context.Context, qc *quic.Conn, pConn net.PacketConn) (io.Closer, error) {
+	tr, owned, err := acquireTransport(pConn)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := qc.AddPath(tr)
+	if err != nil {
+		owned.Close()
+		return nil, err
+	}
+	if err = path.Probe(ctx); err == nil {
+		err = path.Switch()
+	}
+	if err != nil {
+		path.Close()
+		owned.Close()
+		return nil, err
+	}
+	return owned, nil
+}
+
 // --------------------------------------------------------------------------------
+// 一个 net.PacketConn 只能由一个 quic.Transport 处理，共享同一个 UDP socket 的连接使用同一个 quic.Transport，
+// 最后一个连接关闭之后释放该 quic.Transport（不会关闭调用者提供的 UDP socket）。
+var quicTransports = struct {
+	mu sync.Mutex
+	m  map[net.PacketConn]*sharedTransport
+}{m: make(map[net.PacketConn]*sharedTransport)}
+
+type sharedTransport struct {
+	tr   *quic.Transport
+	refs int
+}
+
+// acquireTransport 返回处理 pConn 的 quic.Transport，pConn 为 nil 时创建新的 UDP socket，返回的 io.Closer 用于释放。
+func acquireTransport(pConn net.PacketConn) (*quic.Transport, io.Closer, error) {
+	if pConn == nil {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+		if err != nil {
+			return nil, nil, err
+		}
+		var tr = &quic.Transport{Conn: udpConn}
+		return tr, closerFunc(func() error {
+			tr.Close()
+			return udpConn.Close()
+		}), nil
+	}
+
+	quicTransports.mu.Lock()
+	defer quicTransports.mu.Unlock()
+
+	var st = quicTransports.m[pConn]
+	if st == nil {
+		st = &sharedTransport{tr: &quic.Transport{Conn: pConn}}
+		quicTransports.m[pConn] = st
+	}
+	st.refs++
+
+	var once sync.Once
+	return st.tr, closerFunc(func() error {
+		once.Do(func() {
+			quicTransports.mu.Lock()
+			defer quicTransports.mu.Unlock()
+			st.refs--
+			if st.refs == 0 {
+				delete(quicTransports.m, pConn)
+				st.tr.Close()
+			}
+		})
+		return nil
+	}), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// quicTLSConfig 复制 tlsConf，并在没有设置 NextProtos 时使用 kQUICProtocol。
+func quicTLSConfig(tlsConf *tls.Config) *tls.Config {
+	var c *tls.Config
+	if tlsConf == nil {
+		c = &tls.Config{}
+	} else {
+		c = tlsConf.Clone()
+	}
+	if len(c.NextProtos) == 0 {
+		c.NextProtos = []string{kQUICProtocol}
+	}
+	return c
+}
+
+// serverName 在 tlsConf 没有设置 ServerName 时使用 addr 中的主机名，复制的 tls.Config 共享同一个 ClientSessionCache。
+func serverName(tlsConf *tls.Config, addr string) *tls.Config {
+	if tlsConf.ServerName != "" {
+		return tlsConf
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tlsConf
+	}
+	var c = tlsConf.Clone()
+	c.ServerName = host
+	return c
+}
+
+// quicConfig 复制 config，并启用 DATAGRAM 扩展（RFC 9221）。
+func quicConfig(config *quic.Config) *quic.Config {
+	var c *quic.Config
+	if config == nil {
+		c = &quic.Config{}
+	} else {
+		c = config.Clone()
+	}
+	c.EnableDatagrams = true
+	return c
+}
+
+// --------------------------------------------------------------------------------
+// quicListener 为 quic.Listener 和 quic.EarlyListener 共同的方法。
+type quicListener interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+
+	Addr() net.Addr
+
+	Close() error
+}
+
 type QUICListener struct {
-	ln              quic.Listener
+	ln              quicListener
 	acceptConn      chan *qConn
+	closed          chan struct{}
+	closeOnce       sync.Once
 	ReadBufferSize  int
 	WriteBufferSize int
+	Limiter         *IPLimiter
 }
 
 func (this *QUICListener) doAccept() {
 	for {
-		sess, err := this.ln.Accept(context.Background())
+		qc, err := this.ln.Accept(context.Background())
 		if err != nil {
 			return
 		}
 
-		go func(sess quic.Session) {
-			for {
-				stream, err := sess.AcceptStream(context.Background())
-				if err != nil {
-					sess.Close()
+		select {
+		case <-this.closed:
+			qc.CloseWithError(0, "listener is closed")
+			continue
+		default:
+		}
+
+		if this.Limiter.limitQUIC(qc) == false {
+			continue
+		}
+
+		go func(qc *quic.Conn) {
+			// 启用 0-RTT 时连接在握手完成之前就会被返回，没有使用 0-RTT 的连接等待握手完成之后再交给 Session，
+			// 确保 Session 可以获取到完整的 TLS 状态（比如客户端证书）
+			if qc.ConnectionState().Used0RTT == false {
+				select {
+				case <-qc.HandshakeComplete():
+				case <-qc.Context().Done():
 					return
 				}
+			}
 
-				if stream == nil {
-					sess.Close()
+			// 同一个 QUIC 连接上的所有 Stream 共享一个数据报读取者
+			var datagrams = newQDatagrams(qc)
+			for {
+				stream, err := qc.AcceptStream(context.Background())
+				if err != nil {
+					qc.CloseWithError(0, "")
 					return
 				}
 
-				this.acceptConn <- &qConn{
-					conn: &qSession{sess: sess, Stream: stream},
-					err:  nil,
+				select {
+				case this.acceptConn <- &qConn{conn: newQSession(qc, stream, datagrams, nil), err: nil}:
+				case <-this.closed:
+					// 停止接受之后只重置新的 Stream，同一个 QUIC 连接上已经建立的 Session 不受影响
+					stream.CancelRead(0)
+					stream.CancelWrite(0)
 				}
 			}
-		}(sess)
+		}(qc)
 	}
 }
 
 func (this *QUICListener) Accept() (Conn, error) {
-	ac := <-this.acceptConn
-	if ac.err != nil {
-		return nil, ac.err
+	select {
+	case ac := <-this.acceptConn:
+		if ac.err != nil {
+			return nil, ac.err
+		}
+		return NewConn(ac.conn, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
+	case <-this.closed:
+		return nil, ErrListenerClosed
 	}
-	return NewConn(ac.conn, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
 }
 
+func (this *QUICListener) Addr() net.Addr {
+	return this.ln.Addr()
+}
+
+// StopAccept 停止接受新的连接，新的连接将被拒绝，已经建立的连接不受影响。
+func (this *QUICListener) StopAccept() {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+}
+
+// Close 关闭监听。
+// 注意: 通过 ListenQUIC 创建的监听关闭时会关闭底层的 UDP socket，已经建立的连接也会断开，
+// 如果需要在不断开已有连接的情况下停止接受新的连接，请使用 StopAccept。
+func (this *QUICListener) Close() error {
+	this.StopAccept()
+	return this.ln.Close()
+}
+
+// ListenQUIC 监听 QUIC 连接，config.Allow0RTT 为 true 时接受客户端的 0-RTT 数据。
+// 注意: 0-RTT 数据可能被重放，只有在消息是幂等的或者应用有重放保护时才应该启用。
 func ListenQUIC(addr string, tlsConf *tls.Config, config *quic.Config) (*QUICListener, error) {
-	l, err := quic.ListenAddr(addr, tlsConf, config)
-	if err != nil {
-		return nil, err
+	var c = quicConfig(config)
+	var l quicListener
+	if c.Allow0RTT {
+		el, err := quic.ListenAddrEarly(addr, quicTLSConfig(tlsConf), c)
+		if err != nil {
+			return nil, err
+		}
+		l = el
+	} else {
+		nl, err := quic.ListenAddr(addr, quicTLSConfig(tlsConf), c)
+		if err != nil {
+			return nil, err
+		}
+		l = nl
 	}
 
-	ln := &QUICListener{ln: l, acceptConn: make(chan *qConn, 1)}
+	ln := &QUICListener{ln: l, acceptConn: make(chan *qConn, 1), closed: make(chan struct{})}
 	go ln.doAccept()
 	return ln, nil
 }
 
+// limitQUIC 检查 QUIC 连接是否允许建立，允许建立时在连接关闭之后释放计数。
+func (this *IPLimiter) limitQUIC(qc *quic.Conn) bool {
+	if this == nil {
+		return true
+	}
+	// 连接迁移之后 RemoteAddr 会发生变化，需要释放 Acquire 时的地址
+	var addr = qc.RemoteAddr()
+	if this.Acquire(addr) == false {
+		qc.CloseWithError(0, "too many connections")
+		return false
+	}
+	go func() {
+		<-qc.Context().Done()
+		this.Release(addr)
+	}()
+	return true
+}
+
 // --------------------------------------------------------------------------------
 type qConn struct {
 	conn net.Conn
@@ -141,19 +457,313 @@ type qConn struct {
 
 // --------------------------------------------------------------------------------
 type qSession struct {
-	sess quic.Session
-	quic.Stream
+	conn *quic.Conn
+
+	mu            sync.Mutex
+	stream        *quic.Stream
+	owned         []io.Closer
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// zeroRTT 表示连接使用了 0-RTT 并且还不确定服务端是否接受，early 为握手完成之前写入的数据
+	zeroRTT bool
+	early   []byte
+
+	datagrams *qDatagrams
+	reader    chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newQSession(qc *quic.Conn, stream *quic.Stream, datagrams *qDatagrams, owned io.Closer) *qSession {
+	var s = &qSession{}
+	s.conn = qc
+	s.stream = stream
+	if owned != nil {
+		s.owned = append(s.owned, owned)
+	}
+	s.datagrams = datagrams
+	s.closed = make(chan struct{})
+	return s
+}
+
+func (this *qSession) own(c io.Closer) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	select {
+	case <-this.closed:
+		c.Close()
+		return net.ErrClosed
+	default:
+	}
+	this.owned = append(this.owned, c)
+	return nil
+}
+
+// current 返回当前使用的 Stream，握手完成之后确认 0-RTT 的结果。
+func (this *qSession) current() (*quic.Stream, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.zeroRTT {
+		select {
+		case <-this.conn.HandshakeComplete():
+			if err := this.settle(); err != nil {
+				return nil, err
+			}
+		default:
+		}
+	}
+	return this.stream, nil
+}
+
+// settle 在握手完成之后检查服务端是否接受了 0-RTT，没有接受时 0-RTT 阶段发送的数据都已经失效，
+// 需要在新的 Stream 上重新发送，调用者需要持有 mu。
+func (this *qSession) settle() error {
+	var early = this.early
+	this.zeroRTT = false
+	this.early = nil
+	if this.conn.ConnectionState().Used0RTT {
+		return nil
+	}
+
+	qc, err := this.conn.NextConnection(context.Background())
+	if err != nil {
+		return err
+	}
+	stream, err := qc.OpenStream()
+	if err != nil {
+		return err
+	}
+	stream.SetReadDeadline(this.readDeadline)
+	stream.SetWriteDeadline(this.writeDeadline)
+	if len(early) > 0 {
+		if _, err = stream.Write(early); err != nil {
+			return err
+		}
+	}
+	this.stream = stream
+	return nil
+}
+
+// rejected 在 Stream 返回 quic.Err0RTTRejected 之后等待握手完成，并返回新的 Stream。
+func (this *qSession) rejected() (*quic.Stream, error) {
+	select {
+	case <-this.conn.HandshakeComplete():
+	case <-this.conn.Context().Done():
+		return nil, context.Cause(this.conn.Context())
+	}
+	return this.current()
+}
+
+func (this *qSession) Read(b []byte) (n int, err error) {
+	stream, err := this.current()
+	if err != nil {
+		return 0, err
+	}
+	n, err = stream.Read(b)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if stream, err = this.rejected(); err != nil {
+			return 0, err
+		}
+		return stream.Read(b)
+	}
+	return n, err
+}
+
+func (this *qSession) Write(b []byte) (n int, err error) {
+	stream, err := this.current()
+	if err != nil {
+		return 0, err
+	}
+
+	// 握手完成之前写入的数据需要保留，0-RTT 被拒绝之后重新发送
+	var buffered bool
+	this.mu.Lock()
+	if this.zeroRTT {
+		this.early = append(this.early, b...)
+		buffered = true
+	}
+	this.mu.Unlock()
+
+	n, err = stream.Write(b)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if stream, err = this.rejected(); err != nil {
+			return 0, err
+		}
+		if buffered {
+			return len(b), nil
+		}
+		return stream.Write(b)
+	}
+	return n, err
+}
+
+func (this *qSession) SetDeadline(t time.Time) error {
+	this.SetReadDeadline(t)
+	return this.SetWriteDeadline(t)
+}
+
+func (this *qSession) SetReadDeadline(t time.Time) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.readDeadline = t
+	return this.stream.SetReadDeadline(t)
+}
+
+func (this *qSession) SetWriteDeadline(t time.Time) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.writeDeadline = t
+	return this.stream.SetWriteDeadline(t)
 }
 
 func (this *qSession) LocalAddr() net.Addr {
-	return this.sess.LocalAddr()
+	return this.conn.LocalAddr()
 }
 
 func (this *qSession) RemoteAddr() net.Addr {
-	return this.sess.RemoteAddr()
+	return this.conn.RemoteAddr()
 }
 
 func (this *qSession) Close() error {
-	this.Stream.Close()
-	return this.sess.Close()
+	this.mu.Lock()
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	var stream = this.stream
+	var owned = this.owned
+	var reader = this.reader
+	this.owned = nil
+	this.mu.Unlock()
+
+	if reader != nil {
+		this.datagrams.unregister(reader)
+	}
+	stream.Close()
+	var err = this.conn.CloseWithError(0, "")
+	for _, c := range owned {
+		c.Close()
+	}
+	return err
+}
+
+func (this *qSession) ConnectionState() tls.ConnectionState {
+	return this.conn.ConnectionState().TLS
+}
+
+func (this *qSession) WriteDatagram(data []byte) error {
+	return this.datagrams.write(data)
+}
+
+func (this *qSession) ReadDatagram() ([]byte, error) {
+	this.mu.Lock()
+	if this.reader == nil {
+		this.reader = this.datagrams.register()
+	}
+	var reader = this.reader
+	this.mu.Unlock()
+
+	select {
+	case data, ok := <-reader:
+		if ok == false {
+			return nil, this.datagrams.error()
+		}
+		return data, nil
+	case <-this.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// --------------------------------------------------------------------------------
+const (
+	kDatagramQueueSize = 64
+)
+
+// qDatagrams 读取一个 QUIC 连接的数据报。数据报属于整个 QUIC 连接，每个连接只使用一个 goroutine 读取，
+// 并交给该连接上最早开始读取并且没有关闭的读取者，而不是由多个 Session 随机地获取。
+type qDatagrams struct {
+	conn    *quic.Conn
+	once    sync.Once
+	mu      sync.Mutex
+	readers []chan []byte
+	err     error
+}
+
+func newQDatagrams(qc *quic.Conn) *qDatagrams {
+	return &qDatagrams{conn: qc}
+}
+
+func (this *qDatagrams) write(data []byte) error {
+	var state = this.conn.ConnectionState()
+	if state.SupportsDatagrams.Local == false || state.SupportsDatagrams.Remote == false {
+		return ErrDatagramNotSupported
+	}
+	return this.conn.SendDatagram(data)
+}
+
+func (this *qDatagrams) register() chan []byte {
+	var c = make(chan []byte, kDatagramQueueSize)
+	this.mu.Lock()
+	if this.err != nil {
+		close(c)
+	} else {
+		this.readers = append(this.readers, c)
+	}
+	this.mu.Unlock()
+
+	this.once.Do(func() {
+		go this.run()
+	})
+	return c
+}
+
+func (this *qDatagrams) unregister(c chan []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, r := range this.readers {
+		if r == c {
+			this.readers = append(this.readers[:i:i], this.readers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (this *qDatagrams) error() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.err
+}
+
+func (this *qDatagrams) run() {
+	if this.conn.ConnectionState().SupportsDatagrams.Local == false {
+		this.finish(ErrDatagramNotSupported)
+		return
+	}
+	for {
+		data, err := this.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			this.finish(err)
+			return
+		}
+
+		this.mu.Lock()
+		if len(this.readers) > 0 {
+			select {
+			case this.readers[0] <- data:
+			default:
+				// 读取者处理不过来时丢弃数据报
+			}
+		}
+		this.mu.Unlock()
+	}
+}
+
+func (this *qDatagrams) finish(err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.err = err
+	for _, c := range this.readers {
+		close(c)
+	}
+	this.readers = nil
 }
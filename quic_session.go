@@ -0,0 +1,413 @@
+package bee
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	kMaxChannelHeaderSize = 256
+
+	// 读取通道头的超时时间，避免对端创建 Stream 之后不发送通道头而一直占用资源
+	kChannelHeaderTimeout = 10 * time.Second
+)
+
+var (
+	ErrQUICSessionClosed = errors.New("quic session is closed")
+)
+
+// --------------------------------------------------------------------------------
+// QUICSession 将一个 QUIC 连接抽象为一组逻辑通道，每个通道对应一个独立的 QUIC Stream，通道之间不存在队头阻塞。
+// 同一个 QUICSession 下的所有通道共享同一个 ID，可以将 ID 作为 Session 的 identifier，通道名称作为 Session 的 tag：
+//
+//	bee.NewSession(c, handler, bee.WithIdentifier(qs.ID()), bee.WithTag(name))
+//
+// ID 由各端自己生成，不会在连接中传输，所以两端的 ID 并不相同。
+//
+// 注意: 通道在创建时会写入通道头信息，只能和 DialQUICSession 及 ListenQUICSession 创建的连接进行通信。
+type QUICSession struct {
+	id              string
+	sess            *quic.Conn
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	acceptChannel chan *qChannel
+	closeOnce     sync.Once
+	closed        chan struct{}
+
+	mu    sync.Mutex
+	owned []io.Closer
+
+	datagrams  *qDatagrams
+	readerOnce sync.Once
+	reader     chan []byte
+}
+
+type qChannel struct {
+	name string
+	conn net.Conn
+}
+
+func newQUICSession(id string, sess *quic.Conn, readBufferSize, writeBufferSize int) *QUICSession {
+	var qs = &QUICSession{}
+	qs.id = id
+	qs.sess = sess
+	qs.ReadBufferSize = readBufferSize
+	qs.WriteBufferSize = writeBufferSize
+	qs.acceptChannel = make(chan *qChannel, 8)
+	qs.closed = make(chan struct{})
+	qs.datagrams = newQDatagrams(sess)
+	return qs
+}
+
+func (this *QUICSession) ID() string {
+	return this.id
+}
+
+func (this *QUICSession) LocalAddr() net.Addr {
+	return this.sess.LocalAddr()
+}
+
+func (this *QUICSession) RemoteAddr() net.Addr {
+	return this.sess.RemoteAddr()
+}
+
+// WriteDatagram 通过 QUIC DATAGRAM 扩展发送不可靠数据报，数据报属于整个 QUIC 连接，不属于任何通道。
+func (this *QUICSession) WriteDatagram(data []byte) error {
+	return this.datagrams.write(data)
+}
+
+func (this *QUICSession) ReadDatagram() ([]byte, error) {
+	this.readerOnce.Do(func() {
+		this.reader = this.datagrams.register()
+	})
+	data, ok := <-this.reader
+	if ok == false {
+		return nil, this.datagrams.error()
+	}
+	return data, nil
+}
+
+func (this *QUICSession) ConnectionState() tls.ConnectionState {
+	return this.sess.ConnectionState().TLS
+}
+
+// OpenChannel 创建一个新的通道，对端通过 AcceptChannel 获取该通道。
+func (this *QUICSession) OpenChannel(ctx context.Context, name string) (Conn, error) {
+	stream, err := this.sess.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = writeChannelHeader(stream, name); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	// 通道的创建方作为 WebSocket 协议中的客户端
+	return NewConn(&qStream{sess: this.sess, Stream: stream}, false, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
+}
+
+// AcceptChannel 获取对端创建的通道。
+func (this *QUICSession) AcceptChannel() (name string, c Conn, err error) {
+	select {
+	case ch := <-this.acceptChannel:
+		return ch.name, NewConn(ch.conn, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
+	case <-this.closed:
+		return "", nil, ErrQUICSessionClosed
+	}
+}
+
+// Close 关闭 QUIC 连接及其所有通道。
+func (this *QUICSession) Close() error {
+	var err = this.sess.CloseWithError(0, "")
+	this.closeOnce.Do(func() {
+		close(this.closed)
+
+		this.mu.Lock()
+		var owned = this.owned
+		this.owned = nil
+		this.mu.Unlock()
+		for _, c := range owned {
+			c.Close()
+		}
+	})
+	return err
+}
+
+// Migrate 将 QUICSession 所在的 QUIC 连接迁移到 pConn 上，所有的通道都不会断开，参考 MigrateQUIC。
+func (this *QUICSession) Migrate(ctx context.Context, pConn net.PacketConn) error {
+	owned, err := migrate(ctx, this.sess, pConn)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	select {
+	case <-this.closed:
+		owned.Close()
+		return ErrQUICSessionClosed
+	default:
+	}
+	this.owned = append(this.owned, owned)
+	return nil
+}
+
+func (this *QUICSession) acceptStreams(first *qChannel) {
+	if first != nil {
+		this.pushChannel(first)
+	}
+
+	for {
+		stream, err := this.sess.AcceptStream(context.Background())
+		if err != nil {
+			this.Close()
+			return
+		}
+
+		go func(stream *quic.Stream) {
+			name, err := readStreamHeader(stream)
+			if err != nil {
+				stream.CancelRead(0)
+				stream.Close()
+				return
+			}
+			this.pushChannel(&qChannel{name: name, conn: &qStream{sess: this.sess, Stream: stream}})
+		}(stream)
+	}
+}
+
+func (this *QUICSession) pushChannel(ch *qChannel) {
+	select {
+	case this.acceptChannel <- ch:
+	case <-this.closed:
+		ch.conn.Close()
+	}
+}
+
+// --------------------------------------------------------------------------------
+func (this *QUICDialer) DialSession(ctx context.Context, addr string) (*QUICSession, error) {
+	return this.dialSession(ctx, nil, addr)
+}
+
+func (this *QUICDialer) DialSessionConn(ctx context.Context, pConn net.PacketConn, addr string) (*QUICSession, error) {
+	return this.dialSession(ctx, pConn, addr)
+}
+
+func (this *QUICDialer) dialSession(ctx context.Context, pConn net.PacketConn, addr string) (*QUICSession, error) {
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建通道时需要写入通道头，不使用 0-RTT，避免 0-RTT 被拒绝之后需要重新创建所有的通道
+	sess, owned, err := this.dial(ctx, pConn, addr, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var qs = newQUICSession(id, sess, this.ReadBufferSize, this.WriteBufferSize)
+	qs.owned = append(qs.owned, owned)
+	go qs.acceptStreams(nil)
+	return qs, nil
+}
+
+func DialQUICSession(addr string, tlsConf *tls.Config, config *quic.Config) (*QUICSession, error) {
+	var d QUICDialer
+	d.tlsConf = tlsConf
+	d.config = config
+	return d.DialSession(context.Background(), addr)
+}
+
+// --------------------------------------------------------------------------------
+type QUICSessionListener struct {
+	ln              *quic.Listener
+	acceptSession   chan *QUICSession
+	closed          chan struct{}
+	closeOnce       sync.Once
+	ReadBufferSize  int
+	WriteBufferSize int
+	Limiter         *IPLimiter
+}
+
+func (this *QUICSessionListener) doAccept() {
+	for {
+		sess, err := this.ln.Accept(context.Background())
+		if err != nil {
+			this.Close()
+			return
+		}
+
+		select {
+		case <-this.closed:
+			sess.CloseWithError(0, "listener is closed")
+			continue
+		default:
+		}
+
+		if this.Limiter.limitQUIC(sess) == false {
+			continue
+		}
+
+		go func(sess *quic.Conn) {
+			// 客户端创建第一个通道之后才能确认连接可用，Session 的 ID 由服务端生成
+			var ctx, cancel = context.WithTimeout(context.Background(), kChannelHeaderTimeout)
+			stream, err := sess.AcceptStream(ctx)
+			cancel()
+			if err != nil {
+				sess.CloseWithError(0, "")
+				return
+			}
+
+			name, err := readStreamHeader(stream)
+			if err != nil {
+				sess.CloseWithError(0, "")
+				return
+			}
+
+			id, err := newSessionId()
+			if err != nil {
+				sess.CloseWithError(0, "")
+				return
+			}
+
+			var qs = newQUICSession(id, sess, this.ReadBufferSize, this.WriteBufferSize)
+			select {
+			case this.acceptSession <- qs:
+			case <-this.closed:
+				sess.CloseWithError(0, "")
+				return
+			}
+			qs.acceptStreams(&qChannel{name: name, conn: &qStream{sess: sess, Stream: stream}})
+		}(sess)
+	}
+}
+
+// Accept 获取新的 QUICSession，客户端需要创建至少一个通道之后才能被 Accept。
+func (this *QUICSessionListener) Accept() (*QUICSession, error) {
+	select {
+	case qs := <-this.acceptSession:
+		return qs, nil
+	case <-this.closed:
+		return nil, ErrQUICSessionClosed
+	}
+}
+
+func (this *QUICSessionListener) Addr() net.Addr {
+	return this.ln.Addr()
+}
+
+// StopAccept 停止接受新的 QUICSession，已经建立的 QUICSession 不受影响。
+func (this *QUICSessionListener) StopAccept() {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+}
+
+// Close 关闭监听，同 QUICListener 一样，底层的 UDP socket 关闭之后已经建立的 QUICSession 也会断开。
+func (this *QUICSessionListener) Close() error {
+	this.StopAccept()
+	return this.ln.Close()
+}
+
+func ListenQUICSession(addr string, tlsConf *tls.Config, config *quic.Config) (*QUICSessionListener, error) {
+	l, err := quic.ListenAddr(addr, quicTLSConfig(tlsConf), quicConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	var ln = &QUICSessionListener{ln: l, acceptSession: make(chan *QUICSession, 1), closed: make(chan struct{})}
+	go ln.doAccept()
+	return ln, nil
+}
+
+// --------------------------------------------------------------------------------
+// qStream 和 qSession 不同，关闭时只关闭当前的 Stream，不影响同一个 QUIC 连接下的其它通道。
+type qStream struct {
+	sess *quic.Conn
+	*quic.Stream
+}
+
+func (this *qStream) LocalAddr() net.Addr {
+	return this.sess.LocalAddr()
+}
+
+func (this *qStream) RemoteAddr() net.Addr {
+	return this.sess.RemoteAddr()
+}
+
+func (this *qStream) ConnectionState() tls.ConnectionState {
+	return this.sess.ConnectionState().TLS
+}
+
+func (this *qStream) Close() error {
+	this.Stream.CancelRead(0)
+	return this.Stream.Close()
+}
+
+// --------------------------------------------------------------------------------
+func newSessionId() (string, error) {
+	var b = make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeChannelHeader(w io.Writer, name string) error {
+	var b = make([]byte, 0, binary.MaxVarintLen64+len(name))
+	var buf [binary.MaxVarintLen64]byte
+	var n = binary.PutUvarint(buf[:], uint64(len(name)))
+	b = append(b, buf[:n]...)
+	b = append(b, name...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readStreamHeader 读取 Stream 的通道头，超过 kChannelHeaderTimeout 没有读取到完整的通道头时返回错误。
+func readStreamHeader(stream *quic.Stream) (name string, err error) {
+	stream.SetReadDeadline(time.Now().Add(kChannelHeaderTimeout))
+	if name, err = readChannelHeader(stream); err != nil {
+		return "", err
+	}
+	stream.SetReadDeadline(time.Time{})
+	return name, nil
+}
+
+func readChannelHeader(r io.Reader) (string, error) {
+	// 逐字节读取，避免读取到通道头之后的数据
+	var br = &byteReader{r: r}
+	l, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if l > kMaxChannelHeaderSize {
+		return "", errors.New("channel header too large")
+	}
+	var b = make([]byte, l)
+	if _, err = io.ReadFull(br.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type byteReader struct {
+	r io.Reader
+}
+
+func (this *byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(this.r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
@@ -0,0 +1,450 @@
+package reliable
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/smartwalle/bee"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultWindow = 64
+
+	kFrameData  = 1
+	kFrameAck   = 2
+	kFrameHello = 3
+)
+
+var kMagic = []byte{0, 'b', 'r', 'l'}
+
+var (
+	ErrBadFrame = errors.New("reliable: bad frame")
+)
+
+// --------------------------------------------------------------------------------
+type Option interface {
+	Apply(*Manager)
+}
+
+type optionFunc func(*Manager)
+
+func (f optionFunc) Apply(m *Manager) {
+	f(m)
+}
+
+// WithWindow 设置未被确认的消息的最大数量，超出时 Send 将阻塞直到对端确认。
+func WithWindow(n int) Option {
+	return optionFunc(func(m *Manager) {
+		if n <= 0 {
+			n = kDefaultWindow
+		}
+		m.window = n
+	})
+}
+
+// WithPeerExpiry 设置对端断开之后状态的保留时间，超过该时间没有重新连接时，丢弃对端的所有状态（同 Forget），默认不过期。
+// 注意: 对端重新连接时会发现状态已经被丢弃，对端发送给被丢弃的状态且尚未被确认的消息也会被丢弃，所以 expiry 需要大于对端可能重新连接的时间。
+func WithPeerExpiry(expiry time.Duration) Option {
+	return optionFunc(func(m *Manager) {
+		m.expiry = expiry
+	})
+}
+
+// --------------------------------------------------------------------------------
+type pending struct {
+	seq   uint64
+	frame []byte
+}
+
+// peer 保存与一个逻辑对端（identifier + tag）之间的收发状态，在 Session 断开重连之后继续使用。
+//
+// 每个 peer 有一个随机的 epoch，Session 建立之后双方先交换 epoch（hello 帧），收到对端的 hello 之后才开始收发消息。
+// 对端的 epoch 发生变化说明对端的状态已经被丢弃（Forget 或者过期），此时重新开始编号，并丢弃发送给旧状态的未被确认的消息。
+type peer struct {
+	// wmu 保证消息按照序号的顺序写入 Session，写入时不持有 mu，避免阻塞 handleData 及 handleAck
+	wmu sync.Mutex
+
+	mu     sync.Mutex
+	expire *time.Timer
+	epoch  uint64
+	remote uint64
+
+	// attached 为当前连接的 Session，收到对端的 hello 之后才会设置 s
+	attached bee.Session
+	s        bee.Session
+
+	next     uint64
+	pending  []*pending
+	space    chan struct{}
+	expected uint64
+}
+
+func newPeer() *peer {
+	var p = &peer{next: 1, expected: 1, space: make(chan struct{})}
+	for p.epoch == 0 {
+		p.epoch = rand.Uint64()
+	}
+	return p
+}
+
+// reset 丢弃发送给对端旧状态的消息，需要在持有 mu 时调用。
+func (this *peer) reset() {
+	this.next = 1
+	this.expected = 1
+	this.pending = nil
+	close(this.space)
+	this.space = make(chan struct{})
+}
+
+// Manager 为 Session 提供可靠的消息投递：每条消息带有序号，对端收到之后进行确认，
+// 未被确认的消息会在相同 identifier 及 tag 的 Session 重新连接之后重新发送，接收方会丢弃重复的消息。
+// Session 建立之后双方需要先交换 hello 帧，在此之前发送的消息会被保留，交换完成之后发送。
+//
+// 通信双方都需要使用 Manager，并且 Session 的 identifier 及 tag 在重连前后需要保持不变（比如通过 WithIdentifier 或者 WithAuthenticator 设置）。
+//
+// 对端的状态在断开之后仍然会被保留，不再需要时（比如用户注销）需要调用 Forget，或者通过 WithPeerExpiry 设置过期时间。
+type Manager struct {
+	mu     sync.Mutex
+	window int
+	expiry time.Duration
+	peers  map[string]*peer
+}
+
+func NewManager(opts ...Option) *Manager {
+	var m = &Manager{}
+	m.window = kDefaultWindow
+	m.peers = make(map[string]*peer)
+
+	for _, opt := range opts {
+		opt.Apply(m)
+	}
+	return m
+}
+
+// Handler 返回一个包装了 h 的 bee.Handler，h 的 DidReceivedData 只会收到去重之后的消息内容。
+func (this *Manager) Handler(h bee.Handler) bee.Handler {
+	return &handler{m: this, Handler: h}
+}
+
+// Send 发送一条可靠消息，未被确认的消息数量达到窗口大小时阻塞。
+// Session 已经断开时消息将被保留，在重新连接之后发送。
+func (this *Manager) Send(ctx context.Context, s bee.Session, data []byte) error {
+	var p = this.peer(s.Identifier(), s.Tag())
+
+	for {
+		p.wmu.Lock()
+		p.mu.Lock()
+		if len(p.pending) < this.window {
+			break
+		}
+		var space = p.space
+		p.mu.Unlock()
+		p.wmu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var seq = p.next
+	p.next++
+	var frame = encode(kFrameData, seq, data)
+	p.pending = append(p.pending, &pending{seq: seq, frame: frame})
+	var ps = p.s
+	p.mu.Unlock()
+
+	if ps != nil {
+		ps.Write(frame)
+	}
+	p.wmu.Unlock()
+	return nil
+}
+
+// Pending 返回 identifier 及 tag 对应的对端尚未确认的消息数量。
+func (this *Manager) Pending(identifier, tag string) int {
+	this.mu.Lock()
+	var p = this.peers[key(identifier, tag)]
+	this.mu.Unlock()
+
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+// Forget 丢弃 identifier 及 tag 对应的对端的所有状态，包括未被确认的消息。
+func (this *Manager) Forget(identifier, tag string) {
+	this.forget(identifier, tag, nil)
+}
+
+// forget 丢弃对端的状态，p 不为 nil 时只有当前的状态为 p 时才丢弃。
+func (this *Manager) forget(identifier, tag string, p *peer) {
+	this.mu.Lock()
+	var k = key(identifier, tag)
+	if p != nil && this.peers[k] != p {
+		this.mu.Unlock()
+		return
+	}
+	p = this.peers[k]
+	delete(this.peers, k)
+	this.mu.Unlock()
+
+	if p != nil {
+		p.mu.Lock()
+		p.pending = nil
+		if p.expire != nil {
+			p.expire.Stop()
+			p.expire = nil
+		}
+		close(p.space)
+		p.space = make(chan struct{})
+		p.mu.Unlock()
+	}
+}
+
+func (this *Manager) peer(identifier, tag string) *peer {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var k = key(identifier, tag)
+	var p = this.peers[k]
+	if p == nil {
+		p = newPeer()
+		this.peers[k] = p
+	}
+	return p
+}
+
+func (this *Manager) attach(s bee.Session) {
+	var p = this.peer(s.Identifier(), s.Tag())
+
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	p.mu.Lock()
+	p.attached = s
+	p.s = nil
+	if p.expire != nil {
+		p.expire.Stop()
+		p.expire = nil
+	}
+	var epoch = p.epoch
+	p.mu.Unlock()
+
+	s.Write(encode(kFrameHello, epoch, nil))
+}
+
+// handleHello 处理对端的 hello 帧，必要时重新同步序号，然后重新发送所有未被确认的消息。
+func (this *Manager) handleHello(s bee.Session, epoch uint64) {
+	var p = this.peer(s.Identifier(), s.Tag())
+
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	p.mu.Lock()
+	if p.attached != s {
+		p.mu.Unlock()
+		return
+	}
+	if p.remote != epoch {
+		if p.remote != 0 {
+			// 对端的状态已经被丢弃，对端会从序号 1 开始接收及发送
+			p.reset()
+		}
+		p.remote = epoch
+		p.expected = 1
+	}
+	p.s = s
+	var frames = make([][]byte, 0, len(p.pending))
+	for _, m := range p.pending {
+		frames = append(frames, m.frame)
+	}
+	p.mu.Unlock()
+
+	for _, frame := range frames {
+		if _, err := s.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (this *Manager) detach(s bee.Session) {
+	var identifier, tag = s.Identifier(), s.Tag()
+
+	this.mu.Lock()
+	var p = this.peers[key(identifier, tag)]
+	this.mu.Unlock()
+
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.attached != s {
+		return
+	}
+	p.attached = nil
+	p.s = nil
+
+	if this.expiry > 0 {
+		var expire *time.Timer
+		expire = time.AfterFunc(this.expiry, func() {
+			p.mu.Lock()
+			var expired = p.expire == expire
+			p.mu.Unlock()
+
+			if expired {
+				this.forget(identifier, tag, p)
+			}
+		})
+		p.expire = expire
+	}
+}
+
+// handleData 处理数据帧，返回需要交给应用处理的数据，重复的消息返回 nil。
+func (this *Manager) handleData(s bee.Session, seq uint64, data []byte) []byte {
+	var p = this.peer(s.Identifier(), s.Tag())
+
+	p.mu.Lock()
+	if p.s != s {
+		// 没有完成 hello 交换的 Session 发送的消息无法确定属于哪个状态
+		p.mu.Unlock()
+		return nil
+	}
+	var deliver = false
+	if seq == p.expected {
+		p.expected++
+		deliver = true
+	}
+	var ack = p.expected - 1
+	p.mu.Unlock()
+
+	s.Write(encode(kFrameAck, ack, nil))
+
+	if deliver {
+		return data
+	}
+	return nil
+}
+
+func (this *Manager) handleAck(s bee.Session, seq uint64) {
+	var p = this.peer(s.Identifier(), s.Tag())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.s != s {
+		return
+	}
+
+	var i = 0
+	for i < len(p.pending) && p.pending[i].seq <= seq {
+		i++
+	}
+	if i > 0 {
+		p.pending = append(p.pending[:0:0], p.pending[i:]...)
+		close(p.space)
+		p.space = make(chan struct{})
+	}
+}
+
+func key(identifier, tag string) string {
+	return identifier + "\x00" + tag
+}
+
+// --------------------------------------------------------------------------------
+func isFrame(data []byte) bool {
+	return len(data) > len(kMagic) && bytes.Equal(data[:len(kMagic)], kMagic)
+}
+
+func encode(typ byte, seq uint64, data []byte) []byte {
+	var b = make([]byte, 0, len(kMagic)+1+binary.MaxVarintLen64+len(data))
+	b = append(b, kMagic...)
+	b = append(b, typ)
+	var buf [binary.MaxVarintLen64]byte
+	var n = binary.PutUvarint(buf[:], seq)
+	b = append(b, buf[:n]...)
+	return append(b, data...)
+}
+
+func decode(b []byte) (typ byte, seq uint64, data []byte, err error) {
+	if isFrame(b) == false {
+		return 0, 0, nil, ErrBadFrame
+	}
+	b = b[len(kMagic):]
+	typ = b[0]
+	seq, n := binary.Uvarint(b[1:])
+	if n <= 0 {
+		return 0, 0, nil, ErrBadFrame
+	}
+	return typ, seq, b[1+n:], nil
+}
+
+// --------------------------------------------------------------------------------
+type handler struct {
+	m *Manager
+	bee.Handler
+}
+
+func (this *handler) DidOpenSession(s bee.Session) {
+	this.m.attach(s)
+	if this.Handler != nil {
+		this.Handler.DidOpenSession(s)
+	}
+}
+
+func (this *handler) DidClosedSession(s bee.Session, err error) {
+	this.m.detach(s)
+	if this.Handler != nil {
+		this.Handler.DidClosedSession(s, err)
+	}
+}
+
+func (this *handler) DidWrittenData(s bee.Session, data []byte) {
+	if isFrame(data) {
+		typ, _, payload, err := decode(data)
+		if err != nil || typ != kFrameData {
+			return
+		}
+		data = payload
+	}
+	if this.Handler != nil {
+		this.Handler.DidWrittenData(s, data)
+	}
+}
+
+func (this *handler) DidReceivedData(s bee.Session, data []byte) {
+	if isFrame(data) {
+		typ, seq, payload, err := decode(data)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case kFrameData:
+			if data = this.m.handleData(s, seq, payload); data == nil {
+				return
+			}
+		case kFrameAck:
+			this.m.handleAck(s, seq)
+			return
+		case kFrameHello:
+			this.m.handleHello(s, seq)
+			return
+		default:
+			return
+		}
+	}
+	if this.Handler != nil {
+		this.Handler.DidReceivedData(s, data)
+	}
+}
@@ -0,0 +1,280 @@
+package reliable
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartwalle/bee"
+)
+
+const kTestTimeout = 3 * time.Second
+
+type testHandler struct {
+	received chan string
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{received: make(chan string, 64)}
+}
+
+func (this *testHandler) DidOpenSession(s bee.Session) {
+}
+
+func (this *testHandler) DidClosedSession(s bee.Session, err error) {
+}
+
+func (this *testHandler) DidWrittenData(s bee.Session, data []byte) {
+}
+
+func (this *testHandler) DidReceivedData(s bee.Session, data []byte) {
+	if data != nil {
+		this.received <- string(data)
+	}
+}
+
+func (this *testHandler) expect(t *testing.T, data ...string) {
+	t.Helper()
+	for _, d := range data {
+		select {
+		case got := <-this.received:
+			if got != d {
+				t.Fatalf("expected %q, got %q", d, got)
+			}
+		case <-time.After(kTestTimeout):
+			t.Fatalf("timeout waiting for %q", d)
+		}
+	}
+}
+
+func (this *testHandler) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case got := <-this.received:
+		t.Fatalf("unexpected message %q", got)
+	default:
+	}
+}
+
+// fakeSession 记录写入的帧，用于直接驱动 Manager 的状态。
+type fakeSession struct {
+	bee.Session
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (this *fakeSession) Identifier() string {
+	return "peer"
+}
+
+func (this *fakeSession) Tag() string {
+	return "default"
+}
+
+func (this *fakeSession) Write(data []byte) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.frames = append(this.frames, data)
+	return len(data), nil
+}
+
+// last 返回最后写入的帧的类型及序号。
+func (this *fakeSession) last(t *testing.T) (byte, uint64) {
+	t.Helper()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.frames) == 0 {
+		t.Fatal("no frame written")
+	}
+	typ, seq, _, err := decode(this.frames[len(this.frames)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typ, seq
+}
+
+// open 模拟 Session 建立并收到对端 epoch 为 epoch 的 hello 帧。
+func open(h bee.Handler, epoch uint64) *fakeSession {
+	var s = &fakeSession{}
+	h.DidOpenSession(s)
+	h.DidReceivedData(s, encode(kFrameHello, epoch, nil))
+	return s
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	var deadline = time.Now().Add(kTestTimeout)
+	for f() == false {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResend(t *testing.T) {
+	var ln = bee.ListenPipe("reliable")
+	defer ln.Close()
+
+	var sm = NewManager()
+	var server = newTestHandler()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			bee.NewSession(c, sm.Handler(server), bee.WithIdentifier("client"))
+		}
+	}()
+
+	var cm = NewManager()
+	var dial = func() bee.Session {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bee.NewSession(c, cm.Handler(newTestHandler()), bee.WithIdentifier("server"))
+	}
+
+	var ctx = context.Background()
+	var s = dial()
+	cm.Send(ctx, s, []byte("1"))
+	cm.Send(ctx, s, []byte("2"))
+	server.expect(t, "1", "2")
+	waitFor(t, "ack", func() bool { return cm.Pending("server", "default") == 0 })
+
+	// 断开期间发送的消息在重新连接之后发送
+	s.Close()
+	cm.Send(ctx, s, []byte("3"))
+	cm.Send(ctx, s, []byte("4"))
+	if n := cm.Pending("server", "default"); n != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", n)
+	}
+
+	s = dial()
+	defer s.Close()
+	server.expect(t, "3", "4")
+	waitFor(t, "ack", func() bool { return cm.Pending("server", "default") == 0 })
+	server.expectNothing(t)
+}
+
+func TestDuplicate(t *testing.T) {
+	var m = NewManager()
+	var h = newTestHandler()
+	var rh = m.Handler(h)
+	var s = open(rh, 1)
+
+	for _, seq := range []uint64{1, 1, 3, 2, 2, 3} {
+		rh.DidReceivedData(s, encode(kFrameData, seq, []byte{'0' + byte(seq)}))
+	}
+	h.expect(t, "1", "2", "3")
+	h.expectNothing(t)
+	if typ, seq := s.last(t); typ != kFrameAck || seq != 3 {
+		t.Fatalf("expected ack 3, got %d %d", typ, seq)
+	}
+
+	// 重新连接之后对端重新发送的消息不会被重复处理
+	rh.DidClosedSession(s, nil)
+	s = open(rh, 1)
+	rh.DidReceivedData(s, encode(kFrameData, 3, []byte("3")))
+	rh.DidReceivedData(s, encode(kFrameData, 4, []byte("4")))
+	h.expect(t, "4")
+	h.expectNothing(t)
+}
+
+func TestHello(t *testing.T) {
+	var m = NewManager()
+	var h = newTestHandler()
+	var rh = m.Handler(h)
+
+	// 收到 hello 之前不发送及处理消息
+	var s = &fakeSession{}
+	rh.DidOpenSession(s)
+	if typ, _ := s.last(t); typ != kFrameHello {
+		t.Fatalf("expected hello, got %d", typ)
+	}
+	m.Send(context.Background(), s, []byte("a"))
+	rh.DidReceivedData(s, encode(kFrameData, 1, []byte("x")))
+	h.expectNothing(t)
+	if typ, _ := s.last(t); typ != kFrameHello {
+		t.Fatalf("expected no frame after hello, got %d", typ)
+	}
+
+	rh.DidReceivedData(s, encode(kFrameHello, 1, nil))
+	if typ, seq := s.last(t); typ != kFrameData || seq != 1 {
+		t.Fatalf("expected data 1, got %d %d", typ, seq)
+	}
+	rh.DidReceivedData(s, encode(kFrameData, 1, []byte("x")))
+	rh.DidReceivedData(s, encode(kFrameData, 2, []byte("y")))
+	h.expect(t, "x", "y")
+
+	// 对端的 epoch 发生变化，重新开始编号并丢弃未被确认的消息
+	rh.DidClosedSession(s, nil)
+	s = open(rh, 2)
+	if n := m.Pending("peer", "default"); n != 0 {
+		t.Fatalf("expected stale messages to be dropped, got %d", n)
+	}
+	rh.DidReceivedData(s, encode(kFrameData, 1, []byte("z")))
+	h.expect(t, "z")
+
+	m.Send(context.Background(), s, []byte("b"))
+	if typ, seq := s.last(t); typ != kFrameData || seq != 1 {
+		t.Fatalf("expected data 1, got %d %d", typ, seq)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	var m = NewManager(WithWindow(2))
+	var rh = m.Handler(newTestHandler())
+	var s = open(rh, 1)
+
+	m.Send(context.Background(), s, []byte("1"))
+	m.Send(context.Background(), s, []byte("2"))
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Send(ctx, s, []byte("3")); err != context.DeadlineExceeded {
+		t.Fatalf("expected send to block, got %v", err)
+	}
+
+	var done = make(chan error, 1)
+	go func() {
+		done <- m.Send(context.Background(), s, []byte("3"))
+	}()
+	rh.DidReceivedData(s, encode(kFrameAck, 1, nil))
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(kTestTimeout):
+		t.Fatal("send still blocked after ack")
+	}
+	if n := m.Pending("peer", "default"); n != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", n)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	var m = NewManager(WithPeerExpiry(50 * time.Millisecond))
+	var rh = m.Handler(newTestHandler())
+	var s = open(rh, 1)
+	m.Send(context.Background(), s, []byte("1"))
+
+	// 在过期之前重新连接，状态被保留
+	rh.DidClosedSession(s, nil)
+	s = open(rh, 1)
+	time.Sleep(100 * time.Millisecond)
+	if n := m.Pending("peer", "default"); n != 1 {
+		t.Fatalf("expected 1 pending message, got %d", n)
+	}
+
+	rh.DidClosedSession(s, nil)
+	waitFor(t, "peer to expire", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.peers) == 0
+	})
+}
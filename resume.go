@@ -0,0 +1,323 @@
+package bee
+
+import (
+	"bytes"
+	"errors"
+	"github.com/smartwalle/bee/conn"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultResumeGracePeriod = 30 * time.Second
+	kDefaultResumeTimeout     = 10 * time.Second
+)
+
+var (
+	ErrResumeTimeout = errors.New("resume handshake timeout")
+)
+
+// 会话恢复使用的控制帧：magic + 类型 + token。
+var resumeMagic = []byte("\x00brs")
+
+const (
+	resumeHello   byte = 1 // 客户端 -> 服务端，token 为空表示新建 Session
+	resumeNew     byte = 2 // 服务端 -> 客户端，新建 Session 并下发 token
+	resumeResumed byte = 3 // 服务端 -> 客户端，恢复成功并下发新的 token
+)
+
+func newResumeFrame(t byte, token string) []byte {
+	var b = make([]byte, 0, len(resumeMagic)+1+len(token))
+	b = append(b, resumeMagic...)
+	b = append(b, t)
+	b = append(b, token...)
+	return b
+}
+
+func parseResumeFrame(data []byte) (t byte, token string, ok bool) {
+	if len(data) < len(resumeMagic)+1 || bytes.HasPrefix(data, resumeMagic) == false {
+		return 0, "", false
+	}
+	return data[len(resumeMagic)], string(data[len(resumeMagic)+1:]), true
+}
+
+// --------------------------------------------------------------------------------
+// ResumeHandler 是 Handler 可选实现的接口。
+// 连接断开之后 Session 不会立即关闭，而是调用 DidDetachSession 并等待客户端在宽限期内重连，
+// 重连成功之后调用 DidResumeSession，超过宽限期仍未重连时才调用 DidClosedSession。
+type ResumeHandler interface {
+	DidDetachSession(s Session, err error)
+
+	DidResumeSession(s Session)
+}
+
+// --------------------------------------------------------------------------------
+// ResumeManager 记录可以被恢复的 Session。
+// 客户端在宽限期内使用 token 重新连接时，新的连接将被绑定到原来的 Session 上，
+// Session 的 identifier、tag、属性、在 Hub 中的记录以及尚未发送的消息都会被保留。
+type ResumeManager struct {
+	mu       sync.Mutex
+	grace    time.Duration
+	sessions map[string]*session
+}
+
+func NewResumeManager(grace time.Duration) *ResumeManager {
+	if grace <= 0 {
+		grace = kDefaultResumeGracePeriod
+	}
+	var m = &ResumeManager{}
+	m.grace = grace
+	m.sessions = make(map[string]*session)
+	return m
+}
+
+// Len 返回可以被恢复的 Session 数量，包含连接正常以及等待恢复的 Session。
+func (this *ResumeManager) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.sessions)
+}
+
+func (this *ResumeManager) add(token string, s *session) {
+	this.mu.Lock()
+	this.sessions[token] = s
+	this.mu.Unlock()
+}
+
+func (this *ResumeManager) get(token string) *session {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.sessions[token]
+}
+
+func (this *ResumeManager) remove(token string, s *session) {
+	this.mu.Lock()
+	if this.sessions[token] == s {
+		delete(this.sessions, token)
+	}
+	this.mu.Unlock()
+}
+
+// WithResumption 用于服务端，启用会话恢复。
+// 客户端需要使用 WithResumeClient，连接建立之后首先发送恢复请求，服务端收到该请求之后才会打开 Session。
+func WithResumption(m *ResumeManager) Option {
+	return optionFunc(func(s *session) {
+		if m == nil {
+			s.resume = nil
+			return
+		}
+		s.resume = &resumeState{manager: m}
+	})
+}
+
+// --------------------------------------------------------------------------------
+type resumeState struct {
+	manager  *ResumeManager
+	pending  bool
+	token    string
+	detached bool
+	expired  bool
+	wait     *time.Timer
+	timer    *time.Timer
+}
+
+// startResume 在 run 中调用，timeout 为 true 时如果客户端没有在规定时间内发送恢复请求，将关闭连接。
+func (this *session) startResume(timeout bool) {
+	this.resume.pending = true
+	if timeout {
+		this.resume.wait = time.AfterFunc(kDefaultResumeTimeout, func() {
+			this.mu.Lock()
+			var opened = this.isOpened
+			this.mu.Unlock()
+
+			if opened == false {
+				this.CloseWithCode(ClosePolicyViolation, ErrResumeTimeout.Error())
+			}
+		})
+	}
+}
+
+// handshake 在 read goroutine 中处理客户端发送的第一条消息，
+// consumed 表示该消息为恢复请求，resumed 表示连接已经被绑定到其它 Session 上。
+func (this *session) handshake(data []byte) (consumed, resumed bool) {
+	var r = this.resume
+	r.pending = false
+	if r.wait != nil {
+		r.wait.Stop()
+	}
+
+	t, token, ok := parseResumeFrame(data)
+	if ok && t == resumeHello && token != "" {
+		if old := r.manager.get(token); old != nil && old != this && this.transfer(old) {
+			return true, true
+		}
+	}
+
+	if this.auth == nil {
+		this.open()
+	}
+	return ok, false
+}
+
+// issueResumeToken 在 Session 打开时调用，调用者需要持有 mu，生成 token 失败时 Session 不可恢复。
+func (this *session) issueResumeToken() {
+	var r = this.resume
+	token, err := newSessionId()
+	if err != nil {
+		return
+	}
+	r.token = token
+	r.manager.add(r.token, this)
+
+	this.conn.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+	this.conn.WriteMessage(TextMessage, newResumeFrame(resumeNew, r.token))
+}
+
+// transfer 将当前 Session 的连接交给 old，当前 Session 被标记为已关闭，但是不会关闭连接，也不会通知 Handler。
+func (this *session) transfer(old *session) bool {
+	this.mu.Lock()
+	if this.isClosed {
+		this.mu.Unlock()
+		return false
+	}
+	var c = this.conn
+	if this.auth != nil {
+		this.auth.timer.Stop()
+	}
+	this.isClosed = true
+	this.gen++
+	close(this.stop)
+	this.outbox.close()
+	this.mu.Unlock()
+
+	if old.rebind(c) == false {
+		c.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+		c.WriteMessage(CloseMessage, conn.FormatCloseMessage(CloseTryAgainLater, "session expired"))
+		c.Close()
+	}
+	return true
+}
+
+// rebind 将新的连接绑定到 Session 上，如果旧的连接仍然存在，则直接替换。
+func (this *session) rebind(c Conn) bool {
+	this.mu.Lock()
+	var r = this.resume
+	if this.isClosed || r.expired {
+		this.mu.Unlock()
+		return false
+	}
+	if r.detached == false {
+		this.detach(nil)
+	}
+	r.timer.Stop()
+	r.detached = false
+
+	if token, err := newSessionId(); err == nil {
+		r.manager.remove(r.token, this)
+		r.token = token
+		r.manager.add(r.token, this)
+	}
+
+	this.conn = c
+	this.datagram = datagramConn(c)
+	c.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+	c.WriteMessage(TextMessage, newResumeFrame(resumeResumed, r.token))
+	this.start()
+
+	var handler = this.handler
+	var datagram = this.datagram
+	this.mu.Unlock()
+
+	if dh, ok := handler.(DatagramHandler); ok && datagram != nil {
+		go this.readDatagram(dh, datagram)
+	}
+	if rh, ok := handler.(ResumeHandler); ok {
+		rh.DidResumeSession(this)
+	}
+	return true
+}
+
+// detach 断开当前连接，尚未发送的消息保留在队列中，调用者需要持有 mu。
+func (this *session) detach(err error) {
+	var r = this.resume
+	r.detached = true
+	this.gen++
+	close(this.stop)
+	this.conn.Close()
+	r.timer = time.AfterFunc(r.manager.grace, func() {
+		this.mu.Lock()
+		if this.isClosed || r.detached == false {
+			this.mu.Unlock()
+			return
+		}
+		r.expired = true
+		this.mu.Unlock()
+
+		this.close(err)
+	})
+}
+
+// releaseResume 在 Session 关闭时调用，调用者需要持有 mu。
+func (this *session) releaseResume() {
+	var r = this.resume
+	if r.wait != nil {
+		r.wait.Stop()
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.token != "" {
+		r.manager.remove(r.token, this)
+	}
+}
+
+// --------------------------------------------------------------------------------
+// ResumeClient 用于客户端，保存服务端下发的 token，在重新连接时请求恢复之前的 Session。
+// 同一个逻辑连接的多次重连需要使用同一个 ResumeClient。
+type ResumeClient struct {
+	mu    sync.Mutex
+	token string
+
+	// OnResume 在服务端确认之后调用，resumed 为 true 表示恢复了之前的 Session，为 false 表示服务端新建了 Session。
+	OnResume func(s Session, resumed bool)
+}
+
+func NewResumeClient() *ResumeClient {
+	return &ResumeClient{}
+}
+
+func (this *ResumeClient) Token() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.token
+}
+
+// Reset 清除 token，下一次连接将新建 Session。
+func (this *ResumeClient) Reset() {
+	this.mu.Lock()
+	this.token = ""
+	this.mu.Unlock()
+}
+
+func (this *ResumeClient) handle(s Session, data []byte) bool {
+	t, token, ok := parseResumeFrame(data)
+	if ok == false || (t != resumeNew && t != resumeResumed) {
+		return false
+	}
+
+	this.mu.Lock()
+	this.token = token
+	this.mu.Unlock()
+
+	if this.OnResume != nil {
+		this.OnResume(s, t == resumeResumed)
+	}
+	return true
+}
+
+// WithResumeClient 用于客户端，连接建立之后首先向服务端发送恢复请求。
+func WithResumeClient(c *ResumeClient) Option {
+	return optionFunc(func(s *session) {
+		s.resumeClient = c
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/smartwalle/bee"
+	"github.com/smartwalle/bee/cluster"
+	"strings"
+)
+
+// go run server.go -node node1 -cluster 127.0.0.1:9001 -addr :8081
+// go run server.go -node node2 -cluster 127.0.0.1:9002 -addr :8082
+func main() {
+	var node = flag.String("node", "node1", "node id")
+	var addr = flag.String("addr", ":8081", "listen address")
+	var clusterAddr = flag.String("cluster", "127.0.0.1:9001", "cluster listen address")
+	var peers = flag.String("peers", "127.0.0.1:9001,127.0.0.1:9002", "cluster peers")
+	flag.Parse()
+
+	hub, err := cluster.NewHub(bee.NewHub(), cluster.NewTCPBroker(*node, *clusterAddr, strings.Split(*peers, ",")...))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l, err := bee.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var handler = &handler{h: hub}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		bee.NewSession(c, handler)
+	}
+}
+
+type handler struct {
+	h *cluster.Hub
+}
+
+func (this *handler) DidOpenSession(s bee.Session) {
+	this.h.AddSession(s)
+	fmt.Println("open session", s.Identifier(), s.Tag(), this.h.Len())
+}
+
+func (this *handler) DidClosedSession(s bee.Session, err error) {
+	this.h.RemoveSession(s)
+	fmt.Println("close session", this.h.Len())
+}
+
+func (this *handler) DidWrittenData(s bee.Session, data []byte) {
+}
+
+func (this *handler) DidReceivedData(s bee.Session, data []byte) {
+	if data == nil {
+		return
+	}
+	// 广播给集群中的所有 Session
+	this.h.Broadcast(data)
+}
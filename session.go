@@ -1,7 +1,9 @@
 package bee
 
 import (
+	"crypto/tls"
 	"errors"
+	"github.com/smartwalle/bee/conn"
 	"net"
 	"sync"
 	"time"
@@ -48,10 +50,28 @@ const (
 	PongMessage = 10
 )
 
+// Close codes defined in RFC 6455, section 11.7.
+const (
+	CloseNormalClosure     = conn.CloseNormalClosure
+	CloseGoingAway         = conn.CloseGoingAway
+	CloseProtocolError     = conn.CloseProtocolError
+	ClosePolicyViolation   = conn.ClosePolicyViolation
+	CloseMessageTooBig     = conn.CloseMessageTooBig
+	CloseInternalServerErr = conn.CloseInternalServerErr
+	CloseServiceRestart    = conn.CloseServiceRestart
+	CloseTryAgainLater     = conn.CloseTryAgainLater
+)
+
 //var (
 //	kNewLine = []byte{'\n'}
 //)
 
+var (
+	ErrDatagramNotSupported = errors.New("datagram is not supported")
+
+	errSessionClosed = errors.New("session is closed")
+)
+
 // --------------------------------------------------------------------------------
 type Option interface {
 	Apply(*session)
@@ -135,20 +155,37 @@ type Session interface {
 
 	RemoteAddr() net.Addr
 
+	// ConnectionState 返回连接的 TLS 状态（包含对端证书），连接未使用 TLS 时 ok 为 false。
+	ConnectionState() (state tls.ConnectionState, ok bool)
+
 	WriteMessage(data []byte) (err error)
 
+	// WriteMessageWith 将消息加入发送队列，可以通过 opts 设置消息的优先级等。
+	WriteMessageWith(data []byte, opts ...MessageOption) (err error)
+
 	Write(data []byte) (n int, err error)
 
+	// Stats 返回发送队列的统计信息。
+	Stats() SessionStats
+
+	// WriteDatagram 通过不可靠数据报发送数据，数据可能丢失或者乱序，连接不支持时返回 ErrDatagramNotSupported。
+	WriteDatagram(data []byte) (err error)
+
 	Close() error
+
+	// CloseWithCode 向对端发送携带 code 及 reason 的关闭消息之后关闭 Session。
+	CloseWithCode(code int, reason string) error
 }
 
 type session struct {
-	mu      sync.Mutex
-	conn    Conn
-	handler Handler
+	mu       sync.Mutex
+	conn     Conn
+	datagram DatagramConn
+	handler  Handler
 
 	identifier      string
 	tag             string
+	certIdentity    CertIdentityFunc
 	maxMessageSize  int64
 	writeBufferSize int
 
@@ -158,17 +195,56 @@ type session struct {
 	pongWait   time.Duration
 	pingPeriod time.Duration
 
-	send     chan []byte
+	queues   [kPriorityCount]*queueConfig
+	outbox   *outbox
+	dataMu   sync.RWMutex
 	data     map[string]interface{}
+	isOpened bool
 	isClosed bool
+
+	auth *authState
+
+	// gen 标识当前连接，连接断开或者被替换之后旧连接的 read/write goroutine 将不再影响 Session
+	gen          int
+	stop         chan struct{}
+	readDone     chan struct{}
+	resume       *resumeState
+	resumeClient *ResumeClient
+
+	// 移交给其它进程期间保存的连接状态
+	exported       []*message
+	exportedConn   net.Conn
+	exportedBuffer []byte
+
+	attrWatchers []*attrWatcher
+}
+
+type attrWatcher struct {
+	f func(s Session, key string, old, value interface{})
 }
 
 func NewSession(c Conn, handler Handler, opts ...Option) *session {
+	var s = newSession(c, handler, opts...)
+	if s == nil {
+		return nil
+	}
+
+	if err := s.resolveCertIdentity(); err != nil {
+		s.reject(ClosePolicyViolation, err)
+		return nil
+	}
+
+	s.run(true)
+	return s
+}
+
+func newSession(c Conn, handler Handler, opts ...Option) *session {
 	if c == nil {
 		return nil
 	}
 	var s = &session{}
 	s.conn = c
+	s.datagram = datagramConn(c)
 	s.handler = handler
 	s.identifier = s.conn.RemoteAddr().String()
 	s.tag = kDefaultTag
@@ -185,14 +261,14 @@ func NewSession(c Conn, handler Handler, opts ...Option) *session {
 	s.pongWait = s.readDeadline
 	s.pingPeriod = (s.pongWait * 9) / 10
 
-	s.send = make(chan []byte, s.writeBufferSize)
+	s.outbox = newOutbox(s.writeBufferSize, s.queues)
 	s.data = make(map[string]interface{})
 	s.isClosed = false
-	s.run()
 	return s
 }
 
-func (this *session) run() {
+// run 启动 Session，handshake 为 false 时（比如从其它进程接收的 Session）跳过认证及会话恢复的握手，直接打开 Session。
+func (this *session) run(handshake bool) {
 	this.mu.Lock()
 
 	if this.isClosed {
@@ -200,28 +276,78 @@ func (this *session) run() {
 		return
 	}
 
+	var needAuth = handshake && this.auth != nil
+	if needAuth {
+		this.startAuth()
+	} else {
+		this.auth = nil
+	}
+
+	var needResume = handshake && this.resume != nil
+	if needResume {
+		this.startResume(needAuth == false)
+	}
+
+	if handshake && this.resumeClient != nil {
+		this.conn.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+		this.conn.WriteMessage(TextMessage, newResumeFrame(resumeHello, this.resumeClient.Token()))
+	}
+
+	this.start()
+	this.mu.Unlock()
+
+	if needAuth == false && needResume == false {
+		this.open()
+	}
+}
+
+// start 为当前连接启动 read/write goroutine，调用者需要持有 mu。
+func (this *session) start() {
+	this.gen++
+	this.stop = make(chan struct{})
+	this.readDone = make(chan struct{})
+
 	var w = &sync.WaitGroup{}
 	w.Add(2)
-	go this.write(w)
-	go this.read(w)
+	go this.write(w, this.conn, this.outbox, this.gen, this.stop)
+	go this.read(w, this.conn, this.gen, this.stop, this.readDone)
 	w.Wait()
+}
+
+func (this *session) open() {
+	this.mu.Lock()
+	if this.isClosed {
+		this.mu.Unlock()
+		return
+	}
+	this.isOpened = true
+	if this.resume != nil {
+		this.issueResumeToken()
+	}
+	var handler = this.handler
+	var datagram = this.datagram
 	this.mu.Unlock()
 
-	if this.handler != nil {
-		this.handler.DidOpenSession(this)
+	if dh, ok := handler.(DatagramHandler); ok && datagram != nil {
+		go this.readDatagram(dh, datagram)
+	}
+
+	if handler != nil {
+		handler.DidOpenSession(this)
 	}
 }
 
-func (this *session) read(w *sync.WaitGroup) {
+func (this *session) read(w *sync.WaitGroup, c Conn, gen int, stop, done chan struct{}) {
 	var err error
 	defer func() {
-		this.close(err)
+		close(done)
+		this.fail(gen, err)
 	}()
 
-	this.conn.SetReadLimit(this.maxMessageSize)
-	this.conn.SetReadDeadline(time.Now().Add(this.pongWait))
-	this.conn.SetPongHandler(func(string) error {
-		this.conn.SetReadDeadline(time.Now().Add(this.pongWait))
+	c.SetReadLimit(this.maxMessageSize)
+	c.SetReadDeadline(time.Now().Add(this.pongWait))
+	c.SetPongHandler(func(string) error {
+		c.SetReadDeadline(time.Now().Add(this.pongWait))
 		return nil
 	})
 
@@ -229,13 +355,49 @@ func (this *session) read(w *sync.WaitGroup) {
 
 	var msg []byte
 	for {
-		if this.isClosed {
+		if closed, _ := this.current(); closed {
 			return
 		}
-		_, msg, err = this.conn.ReadMessage()
+		_, msg, err = c.ReadMessage()
+
+		if this.resume != nil && this.resume.pending {
+			if err != nil {
+				return
+			}
+			consumed, resumed := this.handshake(msg)
+			if resumed {
+				return
+			}
+			if consumed {
+				continue
+			}
+		}
+
+		if this.resumeClient != nil && err == nil && this.resumeClient.handle(this, msg) {
+			continue
+		}
+
+		if this.auth != nil {
+			if err != nil {
+				return
+			}
+			if err = this.authenticate(msg); err != nil {
+				return
+			}
+			continue
+		}
 
-		if this.handler != nil {
-			this.handler.DidReceivedData(this, msg)
+		if err != nil {
+			select {
+			case <-stop:
+				// 连接已经被替换或者移交，不再通知 Handler
+				return
+			default:
+			}
+		}
+
+		if _, handler := this.current(); handler != nil {
+			handler.DidReceivedData(this, msg)
 		}
 
 		if err != nil {
@@ -244,40 +406,74 @@ func (this *session) read(w *sync.WaitGroup) {
 	}
 }
 
-func (this *session) write(w *sync.WaitGroup) {
+// current 返回 Session 是否已经关闭以及当前的 Handler，read goroutine 不持有 mu，需要通过该方法读取。
+func (this *session) current() (closed bool, handler Handler) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.isClosed, this.handler
+}
+
+func (this *session) readDatagram(h DatagramHandler, dc DatagramConn) {
+	for {
+		data, err := dc.ReadDatagram()
+		if err != nil {
+			return
+		}
+		h.DidReceivedDatagram(this, data)
+	}
+}
+
+func (this *session) write(w *sync.WaitGroup, c Conn, ob *outbox, gen int, stop chan struct{}) {
 	var err error
 	var ticker = time.NewTicker(this.pingPeriod)
 	defer func() {
 		ticker.Stop()
-		this.close(err)
+		this.fail(gen, err)
 	}()
 
 	w.Done()
 
 	for {
 		select {
-		case data, ok := <-this.send:
-			this.mu.Lock()
-			if this.isClosed {
-				this.mu.Unlock()
-				return
-			}
-
-			this.conn.SetWriteDeadline(time.Now().Add(this.writeDeadline))
-			if !ok {
-				this.conn.WriteMessage(CloseMessage, []byte{})
-				this.mu.Unlock()
-				return
-			}
-
-			if err = this.conn.WriteMessage(TextMessage, data); err != nil {
+		case <-ob.notify:
+			for {
+				m, closed := ob.pop()
+				if m == nil && closed == false {
+					break
+				}
+
+				this.mu.Lock()
+				if this.isClosed {
+					this.mu.Unlock()
+					return
+				}
+				if gen != this.gen {
+					// 连接已经被替换或者移交
+					this.mu.Unlock()
+					if m != nil {
+						ob.requeue(m)
+					}
+					return
+				}
+
+				c.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+				if closed {
+					c.WriteMessage(CloseMessage, []byte{})
+					this.mu.Unlock()
+					return
+				}
+
+				if err = c.WriteMessage(TextMessage, m.data); err != nil {
+					this.mu.Unlock()
+					ob.requeue(m)
+					return
+				}
+				var handler = this.handler
 				this.mu.Unlock()
-				return
-			}
-			this.mu.Unlock()
 
-			if this.handler != nil {
-				this.handler.DidWrittenData(this, data)
+				if handler != nil {
+					handler.DidWrittenData(this, m.data)
+				}
 			}
 		case <-ticker.C:
 			this.mu.Lock()
@@ -287,10 +483,12 @@ func (this *session) write(w *sync.WaitGroup) {
 			}
 			this.mu.Unlock()
 
-			this.conn.SetWriteDeadline(time.Now().Add(this.writeDeadline))
-			if err = this.conn.WriteMessage(PingMessage, nil); err != nil {
+			c.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+			if err = c.WriteMessage(PingMessage, nil); err != nil {
 				return
 			}
+		case <-stop:
+			return
 		}
 	}
 }
@@ -309,16 +507,63 @@ func (this *session) Tag() string {
 
 func (this *session) Set(key string, value interface{}) {
 	if value != nil {
+		this.dataMu.Lock()
+		if this.data == nil {
+			this.dataMu.Unlock()
+			return
+		}
+		var old = this.data[key]
 		this.data[key] = value
+		var watchers = this.attrWatchers
+		this.dataMu.Unlock()
+
+		for _, w := range watchers {
+			w.f(this, key, old, value)
+		}
 	}
 }
 
 func (this *session) Get(key string) interface{} {
+	this.dataMu.RLock()
+	defer this.dataMu.RUnlock()
 	return this.data[key]
 }
 
 func (this *session) Del(key string) {
+	this.dataMu.Lock()
+	var old, ok = this.data[key]
 	delete(this.data, key)
+	var watchers = this.attrWatchers
+	this.dataMu.Unlock()
+
+	if ok {
+		for _, w := range watchers {
+			w.f(this, key, old, nil)
+		}
+	}
+}
+
+// watchAttributes 监听 Session 属性的变化，value 为 nil 表示属性被删除。
+func (this *session) watchAttributes(f func(s Session, key string, old, value interface{})) (cancel func()) {
+	var w = &attrWatcher{f: f}
+
+	this.dataMu.Lock()
+	var wl = make([]*attrWatcher, 0, len(this.attrWatchers)+1)
+	wl = append(wl, this.attrWatchers...)
+	this.attrWatchers = append(wl, w)
+	this.dataMu.Unlock()
+
+	return func() {
+		this.dataMu.Lock()
+		var wl = make([]*attrWatcher, 0, len(this.attrWatchers))
+		for _, c := range this.attrWatchers {
+			if c != w {
+				wl = append(wl, c)
+			}
+		}
+		this.attrWatchers = wl
+		this.dataMu.Unlock()
+	}
 }
 
 func (this *session) LocalAddr() net.Addr {
@@ -329,15 +574,29 @@ func (this *session) RemoteAddr() net.Addr {
 	return this.conn.RemoteAddr()
 }
 
+func (this *session) ConnectionState() (state tls.ConnectionState, ok bool) {
+	return connectionState(this.conn)
+}
+
 func (this *session) WriteMessage(data []byte) (err error) {
-	select {
-	case this.send <- data:
-		return nil
-	default:
-		err = errors.New("session is closed")
+	return this.WriteMessageWith(data)
+}
+
+func (this *session) WriteMessageWith(data []byte, opts ...MessageOption) (err error) {
+	var m = &message{data: data, priority: PriorityNormal}
+	for _, opt := range opts {
+		opt.Apply(m)
+	}
+
+	if err = this.outbox.push(m); err == errQueueOverflow {
+		err = errSessionClosed
 		this.close(err)
-		return err
 	}
+	return err
+}
+
+func (this *session) Stats() SessionStats {
+	return this.outbox.stats()
 }
 
 func (this *session) Write(data []byte) (n int, err error) {
@@ -365,18 +624,61 @@ func (this *session) Write(data []byte) (n int, err error) {
 		return -1, err
 	}
 
+	var handler = this.handler
 	this.mu.Unlock()
 
-	if this.handler != nil {
-		this.handler.DidWrittenData(this, data)
+	if handler != nil {
+		handler.DidWrittenData(this, data)
 	}
 	return n, err
 }
 
+func (this *session) WriteDatagram(data []byte) (err error) {
+	if this.datagram == nil {
+		return ErrDatagramNotSupported
+	}
+	return this.datagram.WriteDatagram(data)
+}
+
 func (this *session) Close() (err error) {
 	return this.close(nil)
 }
 
+func (this *session) CloseWithCode(code int, reason string) (err error) {
+	this.mu.Lock()
+	if this.isClosed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.conn.SetWriteDeadline(time.Now().Add(this.writeDeadline))
+	this.conn.WriteMessage(CloseMessage, conn.FormatCloseMessage(code, reason))
+	this.mu.Unlock()
+
+	return this.close(&conn.CloseError{Code: code, Text: reason})
+}
+
+// fail 在 read/write goroutine 退出时调用，gen 不是当前连接时忽略；
+// 启用了会话恢复并且 Session 已经打开时，Session 进入等待恢复的状态，否则关闭 Session。
+func (this *session) fail(gen int, err error) {
+	this.mu.Lock()
+	if this.isClosed || gen != this.gen {
+		this.mu.Unlock()
+		return
+	}
+	if this.resume == nil || this.resume.token == "" {
+		this.mu.Unlock()
+		this.close(err)
+		return
+	}
+	this.detach(err)
+	var handler = this.handler
+	this.mu.Unlock()
+
+	if rh, ok := handler.(ResumeHandler); ok {
+		rh.DidDetachSession(this, err)
+	}
+}
+
 func (this *session) close(err error) (nErr error) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -384,16 +686,22 @@ func (this *session) close(err error) (nErr error) {
 	if this.isClosed {
 		return nil
 	}
-	close(this.send)
-	this.send = nil
+	this.outbox.close()
 	this.isClosed = true
 
-	nErr = this.conn.Close()
-	if this.handler != nil {
+	if this.resume != nil {
+		this.releaseResume()
+	}
+	if this.resume == nil || this.resume.detached == false {
+		nErr = this.conn.Close()
+	}
+	if this.handler != nil && this.isOpened {
 		this.handler.DidClosedSession(this, err)
 	}
 	this.conn = nil
+	this.dataMu.Lock()
 	this.data = nil
+	this.dataMu.Unlock()
 	this.handler = nil
 	return nErr
 }
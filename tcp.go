@@ -2,6 +2,7 @@ package bee
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/smartwalle/bee/conn"
 	"net"
 	"time"
@@ -15,6 +16,9 @@ type Dialer struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	WriteBufferPool conn.BufferPool
+
+	// TLSConfig 不为空时，在建立连接之后使用 TLS 进行握手
+	TLSConfig *tls.Config
 }
 
 func (this *Dialer) Dial(network, address string) (Conn, error) {
@@ -26,6 +30,11 @@ func (this *Dialer) DialContext(ctx context.Context, network, address string) (C
 	if err != nil {
 		return nil, err
 	}
+	if this.TLSConfig != nil {
+		if c, err = tlsClient(ctx, c, address, this.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
 	cc := NewConn(c, false, this.ReadBufferSize, this.WriteBufferSize, this.WriteBufferPool, nil, nil)
 	return cc, nil
 }
@@ -57,12 +66,17 @@ type Listener struct {
 	net.Listener
 	ReadBufferSize  int
 	WriteBufferSize int
+	Limiter         *IPLimiter
 }
 
 func (this *Listener) Accept() (Conn, error) {
-	c, err := this.Listener.Accept()
-	if err != nil {
-		return nil, err
+	var c net.Conn
+	var err error
+	for c == nil {
+		if c, err = this.Listener.Accept(); err != nil {
+			return nil, err
+		}
+		c = this.Limiter.limit(c)
 	}
 
 	cc := NewConn(c, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil)
@@ -83,12 +97,17 @@ type TCPListener struct {
 	*net.TCPListener
 	ReadBufferSize  int
 	WriteBufferSize int
+	Limiter         *IPLimiter
 }
 
 func (this *TCPListener) AcceptTCP() (Conn, error) {
-	c, err := this.TCPListener.AcceptTCP()
-	if err != nil {
-		return nil, err
+	var c net.Conn
+	for c == nil {
+		tc, err := this.TCPListener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		c = this.Limiter.limit(tc)
 	}
 
 	cc := NewConn(c, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil)
@@ -96,9 +115,13 @@ func (this *TCPListener) AcceptTCP() (Conn, error) {
 }
 
 func (this *TCPListener) Accept() (Conn, error) {
-	c, err := this.TCPListener.Accept()
-	if err != nil {
-		return nil, err
+	var c net.Conn
+	var err error
+	for c == nil {
+		if c, err = this.TCPListener.Accept(); err != nil {
+			return nil, err
+		}
+		c = this.Limiter.limit(c)
 	}
 	cc := NewConn(c, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil)
 	return cc, nil
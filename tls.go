@@ -0,0 +1,203 @@
+package bee
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrListenerClosed = errors.New("listener is closed")
+)
+
+// --------------------------------------------------------------------------------
+// TLSListener 在独立的 goroutine 中完成 TLS 握手，Accept 返回的连接已经完成握手，
+// 可以通过 Session 的 ConnectionState 获取对端证书。
+type TLSListener struct {
+	ln               net.Listener
+	config           *tls.Config
+	acceptConn       chan net.Conn
+	closed           chan struct{}
+	closeOnce        sync.Once
+	ReadBufferSize   int
+	WriteBufferSize  int
+	HandshakeTimeout time.Duration
+	Limiter          *IPLimiter
+}
+
+func (this *TLSListener) doAccept() {
+	for {
+		c, err := this.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			this.Close()
+			return
+		}
+
+		if c = this.Limiter.limit(c); c == nil {
+			continue
+		}
+
+		go this.handshake(c)
+	}
+}
+
+func (this *TLSListener) handshake(c net.Conn) {
+	var timeout = this.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = kDefaultHandshakeTimeout
+	}
+
+	var tc = tls.Server(c, this.config)
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	select {
+	case this.acceptConn <- tc:
+	case <-this.closed:
+		tc.Close()
+	}
+}
+
+func (this *TLSListener) Accept() (Conn, error) {
+	select {
+	case c := <-this.acceptConn:
+		return NewConn(c, true, this.ReadBufferSize, this.WriteBufferSize, nil, nil, nil), nil
+	case <-this.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (this *TLSListener) Addr() net.Addr {
+	return this.ln.Addr()
+}
+
+func (this *TLSListener) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return this.ln.Close()
+}
+
+// ListenTLS 创建基于 TLS 的监听，config 需要提供 Certificates 或者 GetCertificate，
+// 配合 CertReloader 使用可以在不重启监听的情况下更新证书。
+func ListenTLS(network, address string, config *tls.Config) (*TLSListener, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return nil, errors.New("tls: neither Certificates nor GetCertificate set in Config")
+	}
+
+	var lc net.ListenConfig
+	l, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewTLSListener(l, config), nil
+}
+
+// NewTLSListener 使用已有的监听创建 TLSListener，比如通过 ReceiveHandoff 从旧进程接收的监听。
+func NewTLSListener(l net.Listener, config *tls.Config) *TLSListener {
+	var ln = &TLSListener{ln: l, config: config, acceptConn: make(chan net.Conn, 1), closed: make(chan struct{})}
+	go ln.doAccept()
+	return ln
+}
+
+// --------------------------------------------------------------------------------
+func DialTLS(network, address string, config *tls.Config) (Conn, error) {
+	var d Dialer
+	d.TLSConfig = config
+	return d.Dial(network, address)
+}
+
+func tlsClient(ctx context.Context, c net.Conn, address string, config *tls.Config) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+
+	var tc = tls.Client(c, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(deadline)
+	}
+
+	var errCh = make(chan error, 1)
+	go func() {
+		errCh <- tc.Handshake()
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		tc.Close()
+		<-errCh
+		err = ctx.Err()
+	}
+	if err != nil {
+		tc.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// --------------------------------------------------------------------------------
+// CertReloader 用于在运行期间更新 TLS 证书，新的证书对之后建立的连接生效：
+//
+//	r, _ := bee.NewCertReloader(certFile, keyFile)
+//	ln, _ := bee.ListenTLS("tcp", ":8443", &tls.Config{GetCertificate: r.GetCertificate})
+//	// 证书更新之后
+//	r.Reload()
+type CertReloader struct {
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	var r = &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新从文件中加载证书，加载失败时继续使用原有的证书。
+func (this *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(this.certFile, this.keyFile)
+	if err != nil {
+		return err
+	}
+	this.SetCertificate(cert)
+	return nil
+}
+
+func (this *CertReloader) SetCertificate(cert tls.Certificate) {
+	this.mu.Lock()
+	this.cert = &cert
+	this.mu.Unlock()
+}
+
+func (this *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.cert, nil
+}
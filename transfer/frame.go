@@ -0,0 +1,167 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	kFrameOffer   = 1
+	kFrameAccept  = 2
+	kFrameReject  = 3
+	kFrameChunk   = 4
+	kFrameAck     = 5
+	kFrameDone    = 6
+	kFrameResult  = 7
+	kFrameRequest = 8
+)
+
+var kMagic = []byte{0, 'b', 'f', 't'}
+
+var errBadFrame = errors.New("transfer: bad frame")
+
+// --------------------------------------------------------------------------------
+type frame struct {
+	typ    byte
+	id     string
+	name   string
+	size   int64
+	offset int64
+	hash   []byte
+	data   []byte
+	ok     bool
+	reason string
+}
+
+// IsFrame 判断数据是否为文件传输协议的数据帧。
+func IsFrame(data []byte) bool {
+	return len(data) > len(kMagic) && bytes.Equal(data[:len(kMagic)], kMagic)
+}
+
+func (this *frame) encode() []byte {
+	var b = make([]byte, 0, len(kMagic)+1+binary.MaxVarintLen64*3+len(this.id)+len(this.name)+len(this.hash)+len(this.data)+len(this.reason))
+	b = append(b, kMagic...)
+	b = append(b, this.typ)
+	b = appendString(b, this.id)
+
+	switch this.typ {
+	case kFrameOffer:
+		b = appendString(b, this.name)
+		b = appendInt(b, this.size)
+		b = appendString(b, string(this.hash))
+	case kFrameAccept, kFrameAck, kFrameRequest:
+		b = appendInt(b, this.offset)
+	case kFrameReject:
+		b = appendString(b, this.reason)
+	case kFrameChunk:
+		b = appendInt(b, this.offset)
+		b = append(b, this.data...)
+	case kFrameResult:
+		if this.ok {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		b = appendString(b, this.reason)
+	}
+	return b
+}
+
+func decodeFrame(data []byte) (f *frame, err error) {
+	if IsFrame(data) == false {
+		return nil, errBadFrame
+	}
+	var r = &reader{b: data[len(kMagic):]}
+
+	f = &frame{}
+	f.typ = r.byte()
+	f.id = r.string()
+
+	switch f.typ {
+	case kFrameOffer:
+		f.name = r.string()
+		f.size = r.int()
+		f.hash = []byte(r.string())
+	case kFrameAccept, kFrameAck, kFrameRequest:
+		f.offset = r.int()
+	case kFrameReject:
+		f.reason = r.string()
+	case kFrameChunk:
+		f.offset = r.int()
+		f.data = r.rest()
+	case kFrameDone:
+	case kFrameResult:
+		f.ok = r.byte() == 1
+		f.reason = r.string()
+	default:
+		return nil, errBadFrame
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return f, nil
+}
+
+func appendInt(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	var n = binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	var n = binary.PutUvarint(buf[:], uint64(len(s)))
+	b = append(b, buf[:n]...)
+	return append(b, s...)
+}
+
+// --------------------------------------------------------------------------------
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (this *reader) byte() byte {
+	if this.err != nil || len(this.b) < 1 {
+		this.err = errBadFrame
+		return 0
+	}
+	var c = this.b[0]
+	this.b = this.b[1:]
+	return c
+}
+
+func (this *reader) int() int64 {
+	if this.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(this.b)
+	if n <= 0 {
+		this.err = errBadFrame
+		return 0
+	}
+	this.b = this.b[n:]
+	return v
+}
+
+func (this *reader) string() string {
+	if this.err != nil {
+		return ""
+	}
+	l, n := binary.Uvarint(this.b)
+	if n <= 0 || uint64(len(this.b)-n) < l {
+		this.err = errBadFrame
+		return ""
+	}
+	var s = string(this.b[n : n+int(l)])
+	this.b = this.b[n+int(l):]
+	return s
+}
+
+func (this *reader) rest() []byte {
+	var b = this.b
+	this.b = nil
+	return b
+}
@@ -0,0 +1,55 @@
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFrameCodec(t *testing.T) {
+	var tests = []*frame{
+		{typ: kFrameOffer, id: "f1", name: "a.txt", size: 1 << 40, hash: []byte{1, 2, 3}},
+		{typ: kFrameAccept, id: "f1", offset: 512},
+		{typ: kFrameReject, id: "f1", reason: "no space"},
+		{typ: kFrameChunk, id: "f1", offset: 1024, data: []byte("chunk")},
+		{typ: kFrameAck, id: "f1", offset: 2048},
+		{typ: kFrameDone, id: "f1"},
+		{typ: kFrameResult, id: "f1", ok: true},
+		{typ: kFrameResult, id: "f1", reason: ErrHashMismatch.Error()},
+		{typ: kFrameRequest, id: "f1"},
+	}
+
+	for _, test := range tests {
+		var data = test.encode()
+		if IsFrame(data) == false {
+			t.Fatalf("frame %d is not recognized", test.typ)
+		}
+		f, err := decodeFrame(data)
+		if err != nil {
+			t.Fatalf("decode frame %d: %v", test.typ, err)
+		}
+		if reflect.DeepEqual(f, test) == false {
+			t.Fatalf("expected %+v, got %+v", test, f)
+		}
+	}
+}
+
+func TestFrameDecodeError(t *testing.T) {
+	var offer = (&frame{typ: kFrameOffer, id: "f1", name: "a.txt", size: 10}).encode()
+
+	var tests = []struct {
+		name string
+		data []byte
+	}{
+		{"no magic", []byte("hello")},
+		{"magic only", kMagic},
+		{"unknown type", append(append([]byte{}, kMagic...), 99, 0)},
+		{"truncated", offer[:len(offer)-1]},
+		{"bad length", append(append([]byte{}, kMagic...), kFrameReject, 0, 10, 'a')},
+	}
+
+	for _, test := range tests {
+		if _, err := decodeFrame(test.data); err == nil {
+			t.Fatalf("%s: expected error", test.name)
+		}
+	}
+}
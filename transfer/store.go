@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"errors"
+	"github.com/smartwalle/bee"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------
+type FileInfo struct {
+	ID   string
+	Name string
+	Size int64
+	Hash []byte // SHA-256
+}
+
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Store 负责保存接收到的文件。
+// Create 返回用于写入的文件以及已经接收到的数据长度，传输会从该位置继续，用于实现断点续传。
+// Finish 在传输结束时调用，err 为 nil 表示文件已接收完整并且通过了 SHA-256 校验。
+type Store interface {
+	Create(s bee.Session, info FileInfo) (f File, offset int64, err error)
+
+	Finish(s bee.Session, info FileInfo, err error)
+}
+
+// SourceFile 为 Source 打开的文件，发送结束之后会被关闭。
+type SourceFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Source 用于响应对端的下载请求。
+// Finish 在发送结束时调用，err 为 nil 表示对端已接收完整并且通过了 SHA-256 校验。
+type Source interface {
+	Open(s bee.Session, id string) (f SourceFile, info FileInfo, err error)
+
+	Finish(s bee.Session, info FileInfo, err error)
+}
+
+// --------------------------------------------------------------------------------
+type dirStore struct {
+	dir string
+}
+
+// NewDirStore 将文件保存到 dir 目录下，接收中的文件以 .part 作为后缀，接收完成并校验通过之后重命名为 ID。
+func NewDirStore(dir string) Store {
+	return &dirStore{dir: dir}
+}
+
+func (this *dirStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", errors.New("transfer: invalid file id")
+	}
+	return filepath.Join(this.dir, id), nil
+}
+
+func (this *dirStore) Create(s bee.Session, info FileInfo) (File, int64, error) {
+	p, err := this.path(info.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.OpenFile(p+".part", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	var offset = fi.Size()
+	if offset > info.Size {
+		if err = f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		offset = 0
+	}
+	return f, offset, nil
+}
+
+func (this *dirStore) Finish(s bee.Session, info FileInfo, err error) {
+	p, pErr := this.path(info.ID)
+	if pErr != nil {
+		return
+	}
+	if err == nil {
+		os.Rename(p+".part", p)
+	} else if err == ErrHashMismatch {
+		os.Remove(p + ".part")
+	}
+	// 其它错误（比如连接断开）保留 .part 文件，以便重连之后续传
+}
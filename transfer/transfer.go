@@ -0,0 +1,490 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/smartwalle/bee"
+	"io"
+	"sync"
+)
+
+const (
+	// 数据块加上协议头之后需要小于 bee.Session 默认的 MaxMessageSize（1024）
+	kDefaultChunkSize     = 512
+	kDefaultWindow        = 8
+	kDefaultMaxConcurrent = 4
+)
+
+var (
+	ErrHashMismatch   = errors.New("transfer: sha256 mismatch")
+	ErrSessionClosed  = errors.New("transfer: session is closed")
+	ErrTransferExists = errors.New("transfer: transfer already in progress")
+	ErrNotSupported   = errors.New("transfer: not supported")
+)
+
+// --------------------------------------------------------------------------------
+type Option interface {
+	Apply(*Manager)
+}
+
+type optionFunc func(*Manager)
+
+func (f optionFunc) Apply(m *Manager) {
+	f(m)
+}
+
+// WithChunkSize 设置每个数据块的大小，默认为 512，数据块加上协议头之后不能超过对端 Session 的 MaxMessageSize，
+// 使用更大的数据块时对端需要通过 bee.WithMaxMessageSize 调整 MaxMessageSize。
+func WithChunkSize(size int) Option {
+	return optionFunc(func(m *Manager) {
+		if size <= 0 {
+			size = kDefaultChunkSize
+		}
+		m.chunkSize = size
+	})
+}
+
+// WithWindow 设置单个传输任务在未收到确认时最多可以发送的数据块数量。
+func WithWindow(n int) Option {
+	return optionFunc(func(m *Manager) {
+		if n <= 0 {
+			n = kDefaultWindow
+		}
+		m.window = n
+	})
+}
+
+// WithMaxConcurrent 设置同时进行发送的传输任务数量。
+func WithMaxConcurrent(n int) Option {
+	return optionFunc(func(m *Manager) {
+		if n <= 0 {
+			n = kDefaultMaxConcurrent
+		}
+		m.maxConcurrent = n
+	})
+}
+
+func WithStore(store Store) Option {
+	return optionFunc(func(m *Manager) {
+		m.store = store
+	})
+}
+
+func WithSource(source Source) Option {
+	return optionFunc(func(m *Manager) {
+		m.source = source
+	})
+}
+
+func WithReceiveProgress(h func(s bee.Session, info FileInfo, received int64)) Option {
+	return optionFunc(func(m *Manager) {
+		m.receiveProgress = h
+	})
+}
+
+// --------------------------------------------------------------------------------
+type outgoing struct {
+	events chan *frame
+	closed chan struct{}
+}
+
+type incoming struct {
+	info   FileInfo
+	file   File
+	offset int64
+}
+
+type Manager struct {
+	mu              sync.Mutex
+	chunkSize       int
+	window          int
+	maxConcurrent   int
+	sem             chan struct{}
+	store           Store
+	source          Source
+	receiveProgress func(s bee.Session, info FileInfo, received int64)
+	outgoing        map[bee.Session]map[string]*outgoing
+	incoming        map[bee.Session]map[string]*incoming
+}
+
+func NewManager(opts ...Option) *Manager {
+	var m = &Manager{}
+	m.chunkSize = kDefaultChunkSize
+	m.window = kDefaultWindow
+	m.maxConcurrent = kDefaultMaxConcurrent
+
+	for _, opt := range opts {
+		opt.Apply(m)
+	}
+
+	m.sem = make(chan struct{}, m.maxConcurrent)
+	m.outgoing = make(map[bee.Session]map[string]*outgoing)
+	m.incoming = make(map[bee.Session]map[string]*incoming)
+	return m
+}
+
+// Handler 返回一个包装了 h 的 bee.Handler，文件传输相关的数据帧由 Manager 处理，其它数据交由 h 处理。
+func (this *Manager) Handler(h bee.Handler) bee.Handler {
+	return &handler{m: this, Handler: h}
+}
+
+// HandleData 处理文件传输相关的数据帧，如果 data 不是文件传输相关的数据帧，则返回 false。
+func (this *Manager) HandleData(s bee.Session, data []byte) bool {
+	if IsFrame(data) == false {
+		return false
+	}
+	f, err := decodeFrame(data)
+	if err != nil {
+		return true
+	}
+
+	switch f.typ {
+	case kFrameOffer:
+		this.handleOffer(s, f)
+	case kFrameChunk:
+		this.handleChunk(s, f)
+	case kFrameDone:
+		this.handleDone(s, f)
+	case kFrameRequest:
+		this.handleRequest(s, f)
+	case kFrameAccept, kFrameReject, kFrameAck, kFrameResult:
+		this.mu.Lock()
+		var o = this.outgoing[s][f.id]
+		this.mu.Unlock()
+		if o != nil {
+			select {
+			case o.events <- f:
+			case <-o.closed:
+			}
+		}
+	}
+	return true
+}
+
+// CloseSession 释放 Session 相关的传输任务，正在进行的传输任务将返回 ErrSessionClosed。
+func (this *Manager) CloseSession(s bee.Session, err error) {
+	this.mu.Lock()
+	var om = this.outgoing[s]
+	var im = this.incoming[s]
+	delete(this.outgoing, s)
+	delete(this.incoming, s)
+	this.mu.Unlock()
+
+	for _, o := range om {
+		close(o.closed)
+	}
+	for _, in := range im {
+		this.finishIncoming(s, in, ErrSessionClosed)
+	}
+}
+
+// Send 向 Session 发送文件，该方法会阻塞直到对端确认接收完成。
+// 如果对端已经接收过部分数据（比如重连之后使用相同的 ID 重新发送），将从对端已接收的位置继续发送。
+// progress 在每次收到对端的确认时调用。
+func (this *Manager) Send(ctx context.Context, s bee.Session, info FileInfo, r io.ReaderAt, progress func(sent, total int64)) (err error) {
+	select {
+	case this.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-this.sem
+	}()
+
+	if info.Hash == nil {
+		var h = sha256.New()
+		if _, err = io.Copy(h, io.NewSectionReader(r, 0, info.Size)); err != nil {
+			return err
+		}
+		info.Hash = h.Sum(nil)
+	}
+
+	o, err := this.addOutgoing(s, info.ID)
+	if err != nil {
+		return err
+	}
+	defer this.removeOutgoing(s, info.ID, o)
+
+	if err = write(s, &frame{typ: kFrameOffer, id: info.ID, name: info.Name, size: info.Size, hash: info.Hash}); err != nil {
+		return err
+	}
+
+	var acked int64 = -1
+	var sent int64
+	var done bool
+	var buf = make([]byte, this.chunkSize)
+	var window = int64(this.window * this.chunkSize)
+
+	for {
+		// 未收到对端确认的数据超过窗口大小时，等待对端确认，避免发送队列被文件数据占满
+		for acked < 0 || done || (sent < info.Size && sent-acked >= window) {
+			var f *frame
+			select {
+			case f = <-o.events:
+			case <-o.closed:
+				return ErrSessionClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			switch f.typ {
+			case kFrameAccept:
+				acked = f.offset
+				sent = f.offset
+			case kFrameReject:
+				return errors.New(f.reason)
+			case kFrameAck:
+				acked = f.offset
+				if progress != nil {
+					progress(acked, info.Size)
+				}
+			case kFrameResult:
+				if f.ok {
+					return nil
+				}
+				if f.reason == ErrHashMismatch.Error() {
+					return ErrHashMismatch
+				}
+				return errors.New(f.reason)
+			}
+		}
+
+		if sent >= info.Size {
+			if err = write(s, &frame{typ: kFrameDone, id: info.ID}); err != nil {
+				return err
+			}
+			done = true
+			continue
+		}
+
+		var n int
+		n, err = r.ReadAt(buf, sent)
+		if n > 0 {
+			if err = write(s, &frame{typ: kFrameChunk, id: info.ID, offset: sent, data: buf[:n]}); err != nil {
+				return err
+			}
+			sent += int64(n)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Request 请求对端发送指定 ID 的文件，对端需要通过 WithSource 提供文件。
+// 接收到的文件由本地的 Store 保存，如果 Store 中已存在部分数据，将从该位置继续下载。
+func (this *Manager) Request(s bee.Session, id string) error {
+	if this.store == nil {
+		return ErrNotSupported
+	}
+	return write(s, &frame{typ: kFrameRequest, id: id})
+}
+
+func (this *Manager) addOutgoing(s bee.Session, id string) (*outgoing, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var om = this.outgoing[s]
+	if om == nil {
+		om = make(map[string]*outgoing)
+		this.outgoing[s] = om
+	}
+	if _, ok := om[id]; ok {
+		return nil, ErrTransferExists
+	}
+	var o = &outgoing{events: make(chan *frame, this.window+2), closed: make(chan struct{})}
+	om[id] = o
+	return o, nil
+}
+
+func (this *Manager) removeOutgoing(s bee.Session, id string, o *outgoing) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var om = this.outgoing[s]
+	if om != nil && om[id] == o {
+		delete(om, id)
+		if len(om) == 0 {
+			delete(this.outgoing, s)
+		}
+		// 通知 HandleData 不再向 events 中写入
+		close(o.closed)
+	}
+}
+
+func (this *Manager) handleOffer(s bee.Session, f *frame) {
+	if this.store == nil {
+		write(s, &frame{typ: kFrameReject, id: f.id, reason: ErrNotSupported.Error()})
+		return
+	}
+
+	var info = FileInfo{ID: f.id, Name: f.name, Size: f.size, Hash: f.hash}
+	file, offset, err := this.store.Create(s, info)
+	if err != nil {
+		write(s, &frame{typ: kFrameReject, id: f.id, reason: err.Error()})
+		return
+	}
+
+	this.mu.Lock()
+	var im = this.incoming[s]
+	if im == nil {
+		im = make(map[string]*incoming)
+		this.incoming[s] = im
+	}
+	var old = im[f.id]
+	im[f.id] = &incoming{info: info, file: file, offset: offset}
+	this.mu.Unlock()
+
+	if old != nil {
+		old.file.Close()
+	}
+
+	write(s, &frame{typ: kFrameAccept, id: f.id, offset: offset})
+}
+
+func (this *Manager) handleChunk(s bee.Session, f *frame) {
+	var in = this.getIncoming(s, f.id)
+	if in == nil {
+		return
+	}
+
+	var err error
+	if f.offset != in.offset || in.offset+int64(len(f.data)) > in.info.Size {
+		err = errors.New("transfer: unexpected chunk offset")
+	} else if _, err = in.file.WriteAt(f.data, f.offset); err == nil {
+		in.offset += int64(len(f.data))
+	}
+
+	if err != nil {
+		if this.removeIncoming(s, f.id, in) {
+			this.finishIncoming(s, in, err)
+		}
+		write(s, &frame{typ: kFrameResult, id: f.id, ok: false, reason: err.Error()})
+		return
+	}
+
+	if this.receiveProgress != nil {
+		this.receiveProgress(s, in.info, in.offset)
+	}
+	write(s, &frame{typ: kFrameAck, id: f.id, offset: in.offset})
+}
+
+func (this *Manager) handleDone(s bee.Session, f *frame) {
+	var in = this.getIncoming(s, f.id)
+	if in == nil {
+		return
+	}
+	// CloseSession 已经移除并结束了该传输任务
+	if this.removeIncoming(s, f.id, in) == false {
+		return
+	}
+
+	var err error
+	if in.offset != in.info.Size {
+		err = io.ErrUnexpectedEOF
+	} else {
+		var h = sha256.New()
+		if _, err = io.Copy(h, io.NewSectionReader(in.file, 0, in.info.Size)); err == nil && bytes.Equal(h.Sum(nil), in.info.Hash) == false {
+			err = ErrHashMismatch
+		}
+	}
+
+	this.finishIncoming(s, in, err)
+
+	if err != nil {
+		write(s, &frame{typ: kFrameResult, id: f.id, ok: false, reason: err.Error()})
+		return
+	}
+	write(s, &frame{typ: kFrameResult, id: f.id, ok: true})
+}
+
+func (this *Manager) handleRequest(s bee.Session, f *frame) {
+	if this.source == nil {
+		write(s, &frame{typ: kFrameReject, id: f.id, reason: ErrNotSupported.Error()})
+		return
+	}
+
+	r, info, err := this.source.Open(s, f.id)
+	if err != nil {
+		write(s, &frame{typ: kFrameReject, id: f.id, reason: err.Error()})
+		return
+	}
+	info.ID = f.id
+
+	go func() {
+		var err = this.Send(context.Background(), s, info, r, nil)
+		r.Close()
+		this.source.Finish(s, info, err)
+	}()
+}
+
+func (this *Manager) getIncoming(s bee.Session, id string) *incoming {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.incoming[s][id]
+}
+
+// removeIncoming 移除传输任务，返回 true 时由调用方负责调用 finishIncoming，保证每个传输任务只结束一次。
+func (this *Manager) removeIncoming(s bee.Session, id string, in *incoming) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var im = this.incoming[s]
+	if im == nil || im[id] != in {
+		return false
+	}
+	delete(im, id)
+	if len(im) == 0 {
+		delete(this.incoming, s)
+	}
+	return true
+}
+
+func (this *Manager) finishIncoming(s bee.Session, in *incoming, err error) {
+	in.file.Close()
+	this.store.Finish(s, in.info, err)
+}
+
+func write(s bee.Session, f *frame) error {
+	// 直接写入连接而不经过 Session 的发送队列，和普通消息交替写入
+	_, err := s.Write(f.encode())
+	return err
+}
+
+// --------------------------------------------------------------------------------
+type handler struct {
+	m *Manager
+	bee.Handler
+}
+
+func (this *handler) DidClosedSession(s bee.Session, err error) {
+	this.m.CloseSession(s, err)
+	if this.Handler != nil {
+		this.Handler.DidClosedSession(s, err)
+	}
+}
+
+func (this *handler) DidWrittenData(s bee.Session, data []byte) {
+	if IsFrame(data) {
+		return
+	}
+	if this.Handler != nil {
+		this.Handler.DidWrittenData(s, data)
+	}
+}
+
+func (this *handler) DidReceivedData(s bee.Session, data []byte) {
+	if this.m.HandleData(s, data) {
+		return
+	}
+	if this.Handler != nil {
+		this.Handler.DidReceivedData(s, data)
+	}
+}
+
+func (this *handler) DidOpenSession(s bee.Session) {
+	if this.Handler != nil {
+		this.Handler.DidOpenSession(s)
+	}
+}
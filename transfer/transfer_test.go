@@ -0,0 +1,224 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartwalle/bee"
+)
+
+const kTestTimeout = 3 * time.Second
+
+// recordStore 记录 Finish 的调用。
+type recordStore struct {
+	Store
+	mu       sync.Mutex
+	finished []error
+}
+
+func (this *recordStore) Finish(s bee.Session, info FileInfo, err error) {
+	this.mu.Lock()
+	this.finished = append(this.finished, err)
+	this.mu.Unlock()
+	this.Store.Finish(s, info, err)
+}
+
+func (this *recordStore) results() []error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]error(nil), this.finished...)
+}
+
+// offsetReader 记录第一次读取的位置，read 不为 nil 时，读取第一个数据块之后等待 read 关闭。
+type offsetReader struct {
+	*bytes.Reader
+	mu    sync.Mutex
+	first int64
+	reads int
+	read  chan struct{}
+}
+
+func (this *offsetReader) ReadAt(b []byte, off int64) (int, error) {
+	this.mu.Lock()
+	this.reads++
+	if this.reads == 1 {
+		this.first = off
+	}
+	var wait = this.reads > 1 && this.read != nil
+	this.mu.Unlock()
+
+	if wait {
+		<-this.read
+	}
+	return this.Reader.ReadAt(b, off)
+}
+
+// connect 使用 pipe 连接接收方及发送方，返回发送方的 Session 以及用于获取接收方 Session 的 chan。
+func connect(t *testing.T, receiver, sender *Manager) (bee.Session, chan bee.Session) {
+	var ln = bee.ListenPipe("transfer")
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	var accepted = make(chan bee.Session, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- bee.NewSession(c, receiver.Handler(nil))
+	}()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = bee.NewSession(c, sender.Handler(nil))
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s, accepted
+}
+
+func testFile(size int) ([]byte, FileInfo) {
+	var data = make([]byte, size)
+	rand.Read(data)
+	var sum = sha256.Sum256(data)
+	return data, FileInfo{ID: "f1", Name: "f1.bin", Size: int64(size), Hash: sum[:]}
+}
+
+func TestResume(t *testing.T) {
+	var dir = t.TempDir()
+	var store = &recordStore{Store: NewDirStore(dir)}
+	var sender = NewManager()
+	var s, _ = connect(t, NewManager(WithStore(store)), sender)
+
+	var data, info = testFile(10 * kDefaultChunkSize)
+
+	// 对端已经接收了部分数据
+	var received = 3*kDefaultChunkSize + 100
+	if err := ioutil.WriteFile(filepath.Join(dir, "f1.part"), data[:received], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), kTestTimeout)
+	defer cancel()
+
+	var r = &offsetReader{Reader: bytes.NewReader(data)}
+	var sent int64
+	var progress = func(n, total int64) {
+		sent = n
+	}
+	if err := sender.Send(ctx, s, info, r, progress); err != nil {
+		t.Fatal(err)
+	}
+	if r.first != int64(received) {
+		t.Fatalf("expected to resume from %d, got %d", received, r.first)
+	}
+	if sent != info.Size {
+		t.Fatalf("expected progress %d, got %d", info.Size, sent)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "f1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, data) == false {
+		t.Fatal("received file does not match")
+	}
+	if results := store.results(); len(results) != 1 || results[0] != nil {
+		t.Fatalf("expected one successful finish, got %v", results)
+	}
+}
+
+func TestHashMismatch(t *testing.T) {
+	var dir = t.TempDir()
+	var store = &recordStore{Store: NewDirStore(dir)}
+	var sender = NewManager()
+	var s, _ = connect(t, NewManager(WithStore(store)), sender)
+
+	var data, info = testFile(4 * kDefaultChunkSize)
+
+	// 已接收的部分数据和发送的文件不一致
+	var part = make([]byte, kDefaultChunkSize)
+	if err := ioutil.WriteFile(filepath.Join(dir, "f1.part"), part, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), kTestTimeout)
+	defer cancel()
+
+	if err := sender.Send(ctx, s, info, &offsetReader{Reader: bytes.NewReader(data)}, nil); err != ErrHashMismatch {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "f1.part")); os.IsNotExist(err) == false {
+		t.Fatal("corrupted part file was kept")
+	}
+	if results := store.results(); len(results) != 1 || results[0] != ErrHashMismatch {
+		t.Fatalf("expected one ErrHashMismatch finish, got %v", results)
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	var dir = t.TempDir()
+	var store = &recordStore{Store: NewDirStore(dir)}
+	var sender = NewManager()
+	var s, accepted = connect(t, NewManager(WithStore(store)), sender)
+
+	var data, info = testFile(4 * kDefaultChunkSize)
+	var r = &offsetReader{Reader: bytes.NewReader(data), read: make(chan struct{})}
+
+	var done = make(chan error, 1)
+	go func() {
+		done <- sender.Send(context.Background(), s, info, r, nil)
+	}()
+
+	var rs bee.Session
+	select {
+	case rs = <-accepted:
+	case <-time.After(kTestTimeout):
+		t.Fatal("timeout waiting for session")
+	}
+
+	// 等待接收方开始接收
+	var deadline = time.Now().Add(kTestTimeout)
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "f1.part")); err == nil && fi.Size() > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the first chunk")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rs.Close()
+	close(r.read)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected send to fail")
+		}
+	case <-time.After(kTestTimeout):
+		t.Fatal("send did not return")
+	}
+
+	// 接收方的 DidClosedSession 和发送方返回没有先后顺序
+	deadline = time.Now().Add(kTestTimeout)
+	for len(store.results()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if results := store.results(); len(results) != 1 || results[0] != ErrSessionClosed {
+		t.Fatalf("expected one ErrSessionClosed finish, got %v", results)
+	}
+}